@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mafredri/electrolux-ocp/ocpapi"
+	"github.com/mafredri/electrolux_exporter/collector"
+	"golang.org/x/exp/slices"
+)
+
+// accountConfig is an additional account, e.g. for a different brand,
+// served by the same exporter.
+type accountConfig struct {
+	Name            string `json:"name"` // Value of the account label.
+	Brand           string `json:"brand"`
+	CountryCode     string `json:"country"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	ClientStateFile string `json:"client_state_file"` // Optional.
+}
+
+// loadAccounts reads a JSON list of accounts from name. The primary
+// account (configured by flags) is named "default".
+func loadAccounts(name string) ([]accountConfig, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read accounts file: %w", err)
+	}
+	var accounts []accountConfig
+	if err := json.Unmarshal(b, &accounts); err != nil {
+		return nil, fmt.Errorf("decode accounts file: %w", err)
+	}
+
+	names := map[string]bool{"default": true}
+	for i, a := range accounts {
+		switch {
+		case a.Name == "" || names[a.Name]:
+			return nil, fmt.Errorf("account %d: missing or duplicate name %q", i, a.Name)
+		case !slices.Contains(brands, a.Brand):
+			return nil, fmt.Errorf("account %s: invalid brand %q", a.Name, a.Brand)
+		case !slices.Contains(countryCodes, a.CountryCode):
+			return nil, fmt.Errorf("account %s: invalid country %q", a.Name, a.CountryCode)
+		case a.Email == "" || a.Password == "":
+			return nil, fmt.Errorf("account %s: missing email or password", a.Name)
+		}
+		names[a.Name] = true
+	}
+	return accounts, nil
+}
+
+// account is an additional account with its own client and collector.
+type account struct {
+	config    accountConfig
+	client    *ocpapi.Client
+	collector *collector.Collector
+	loggedIn  atomic.Bool
+}
+
+// newAccount creates the client and collector for a, the client and
+// collector configuration is shared with the primary account except for
+// the brand, country and client state.
+func newAccount(a accountConfig, config ocpapi.Config, opts collector.Options) (*account, error) {
+	config.Brand = a.Brand
+	config.CountryCode = a.CountryCode
+	config.State, _ = restoreClientState(a.ClientStateFile)
+	client, err := ocpapi.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", a.Name, err)
+	}
+	return &account{
+		config:    a,
+		client:    client,
+		collector: collector.NewCollector(client, &opts),
+	}, nil
+}
+
+// discoverAccounts returns an account for each brand other than the one in
+// config that the email is registered with, so that e.g. AEG appliances are
+// served next to Electrolux ones. Brands already in accounts are skipped.
+func discoverAccounts(ctx context.Context, config ocpapi.Config, email, password, clientStateFile string, accounts []accountConfig) []accountConfig {
+	var discovered []accountConfig
+	for _, brand := range brands {
+		if brand == config.Brand || slices.ContainsFunc(accounts, func(a accountConfig) bool {
+			return a.Name == brand || (a.Brand == brand && a.Email == email)
+		}) {
+			continue
+		}
+
+		cfg := config
+		cfg.Brand = brand
+		cfg.State = ocpapi.State{}
+		client, err := ocpapi.New(cfg)
+		if err != nil {
+			log.Printf("Discover brand %s: %v", brand, err)
+			continue
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		ips, err := client.IdentityProviders(reqCtx, email)
+		cancel()
+		if err != nil {
+			log.Printf("Discover brand %s: %v", brand, err)
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+
+		log.Printf("Discovered %s account for %s", brand, email)
+		a := accountConfig{
+			Name:        brand,
+			Brand:       brand,
+			CountryCode: config.CountryCode,
+			Email:       email,
+			Password:    password,
+		}
+		if clientStateFile != "" {
+			ext := filepath.Ext(clientStateFile)
+			a.ClientStateFile = strings.TrimSuffix(clientStateFile, ext) + "_" + brand + ext
+		}
+		discovered = append(discovered, a)
+	}
+	return discovered
+}
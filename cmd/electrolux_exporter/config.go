@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mafredri/electrolux_exporter/collector"
+)
+
+// reloadableConfig holds the options read from the config file, they are
+// applied on top of the flags and reloaded on SIGHUP. Omitted options keep
+// the value from the flags.
+type reloadableConfig struct {
+	DeviceTypes        *[]string `json:"device_types"`         // Replaces -device-types.
+	DisabledMetrics    []string  `json:"disabled_metrics"`     // In addition to -disable-metric.
+	VOCMolecularWeight *float64  `json:"voc_molecular_weight"` // Replaces -voc-molecular-weight.
+}
+
+// loadConfigFile reads the reloadable options from the JSON file name.
+func loadConfigFile(name string) (cfg reloadableConfig, err error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return cfg, fmt.Errorf("read config file: %w", err)
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("decode config file: %w", err)
+	}
+	if cfg.VOCMolecularWeight != nil {
+		if err := collector.ValidateMolecularWeight(*cfg.VOCMolecularWeight); err != nil {
+			return cfg, fmt.Errorf("config file: voc molecular weight: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// apply returns opts with the options from cfg applied.
+func (cfg reloadableConfig) apply(opts collector.Options) collector.Options {
+	if cfg.DeviceTypes != nil {
+		opts.DeviceTypes = *cfg.DeviceTypes
+	}
+	if len(cfg.DisabledMetrics) > 0 {
+		opts.DisabledMetrics = append(opts.DisabledMetrics[:len(opts.DisabledMetrics):len(opts.DisabledMetrics)], cfg.DisabledMetrics...)
+	}
+	if cfg.VOCMolecularWeight != nil {
+		opts.MolecularWeight = *cfg.VOCMolecularWeight
+	}
+	return opts
+}
+
+// reloadOnHangup reloads the config file name on every signal received
+// from hup and applies it to the collector of the primary and additional
+// accounts, on top of the flag options in base. Credentials and the other
+// options require a restart.
+func reloadOnHangup(hup <-chan os.Signal, name string, base collector.Options, c *collector.Collector, accounts []*account) {
+	for range hup {
+		if name == "" {
+			log.Println("SIGHUP received, no -config-file to reload")
+			continue
+		}
+		log.Printf("SIGHUP received, reloading %s", name)
+		cfg, err := loadConfigFile(name)
+		if err != nil {
+			log.Printf("Error: %v, keeping the current configuration", err)
+			continue
+		}
+		opts := cfg.apply(base)
+		c.SetOptions(&opts)
+		for _, acc := range accounts {
+			acc.collector.SetOptions(&opts)
+		}
+		log.Println("Configuration reloaded successfully")
+	}
+}
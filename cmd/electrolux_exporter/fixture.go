@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/mafredri/electrolux-ocp/ocpapi"
+	"github.com/mafredri/electrolux_exporter/collector"
+)
+
+// fixtureClient serves recorded OCP API responses, e.g. for demos without
+// an Electrolux account.
+type fixtureClient struct {
+	appliances     []ocpapi.Appliance
+	applianceInfos []ocpapi.ApplianceInfo
+
+	rawAppliances json.RawMessage // As recorded, for dump.
+}
+
+var _ collector.ApplianceClient = (*fixtureClient)(nil)
+
+// loadFixtureClient reads a fixture file in the format of the collector
+// test data, e.g.:
+//
+//	{"appliances": [...], "applianceInfos": [...]}
+func loadFixtureClient(name string) (*fixtureClient, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read fixture file: %w", err)
+	}
+	var fixture struct {
+		Appliances     []ocpapi.Appliance     `json:"appliances"`
+		ApplianceInfos []ocpapi.ApplianceInfo `json:"applianceInfos"`
+	}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		return nil, fmt.Errorf("decode fixture file: %w", err)
+	}
+	var raw struct {
+		Appliances json.RawMessage `json:"appliances"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("decode fixture file: %w", err)
+	}
+	return &fixtureClient{
+		appliances:     fixture.Appliances,
+		applianceInfos: fixture.ApplianceInfos,
+		rawAppliances:  raw.Appliances,
+	}, nil
+}
+
+func (f *fixtureClient) Appliances(ctx context.Context, includeMetadata bool) ([]ocpapi.Appliance, error) {
+	return f.appliances, ctx.Err()
+}
+
+// AppliancesInfo returns the info matching the PNC of the requested
+// appliances, like the OCP API.
+func (f *fixtureClient) AppliancesInfo(ctx context.Context, applianceIDs ...string) ([]ocpapi.ApplianceInfo, error) {
+	var infos []ocpapi.ApplianceInfo
+	for _, info := range f.applianceInfos {
+		for _, id := range applianceIDs {
+			if ocpapi.ApplianceID(id).PNC() == info.PNC {
+				infos = append(infos, info)
+				break
+			}
+		}
+	}
+	return infos, ctx.Err()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// influxWriter writes gathered metrics to the InfluxDB v2 write API in
+// line protocol. Each metric family is a measurement, labels are tags.
+type influxWriter struct {
+	url    string // Write endpoint including org, bucket and precision.
+	token  string
+	client *http.Client
+}
+
+func newInfluxWriter(baseURL, org, bucket, token string) (*influxWriter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse influx url: %w", err)
+	}
+	u = u.JoinPath("api/v2/write")
+	q := u.Query()
+	q.Set("org", org)
+	q.Set("bucket", bucket)
+	q.Set("precision", "ms")
+	u.RawQuery = q.Encode()
+
+	return &influxWriter{
+		url:    u.String(),
+		token:  token,
+		client: directClient,
+	}, nil
+}
+
+// Write gathers metrics from g and writes them to InfluxDB.
+func (w *influxWriter) Write(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("gather: %w", err)
+	}
+
+	var buf bytes.Buffer
+	writeLineProtocol(&buf, mfs, time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// writeLineProtocol writes mfs to buf in InfluxDB line protocol, metrics
+// without a timestamp are written with now. Fields are named by metric type,
+// histograms and summaries have a field per bucket or quantile.
+func writeLineProtocol(buf *bytes.Buffer, mfs []*dto.MetricFamily, now time.Time) {
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			fields := make(map[string]float64)
+			var keys []string
+			field := func(k string, v float64) {
+				// Not representable in line protocol.
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					return
+				}
+				fields[k] = v
+				keys = append(keys, k)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				field("gauge", m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				field("counter", m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				field("value", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				field("count", float64(h.GetSampleCount()))
+				field("sum", h.GetSampleSum())
+				for _, b := range h.GetBucket() {
+					field(strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64), float64(b.GetCumulativeCount()))
+				}
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				field("count", float64(s.GetSampleCount()))
+				field("sum", s.GetSampleSum())
+				for _, q := range s.GetQuantile() {
+					field(strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64), q.GetValue())
+				}
+			}
+			if len(keys) == 0 {
+				continue
+			}
+
+			buf.WriteString(influxEscape(mf.GetName(), ", "))
+			for _, l := range m.GetLabel() {
+				// Empty tag values are not allowed.
+				if l.GetValue() == "" {
+					continue
+				}
+				buf.WriteByte(',')
+				buf.WriteString(influxEscape(l.GetName(), ",= "))
+				buf.WriteByte('=')
+				buf.WriteString(influxEscape(l.GetValue(), ",= "))
+			}
+			for i, k := range keys {
+				if i == 0 {
+					buf.WriteByte(' ')
+				} else {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(influxEscape(k, ",= "))
+				buf.WriteByte('=')
+				buf.WriteString(strconv.FormatFloat(fields[k], 'g', -1, 64))
+			}
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(ts, 10))
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// influxEscape backslash-escapes the chars in s, and newlines, which are
+// not allowed in line protocol.
+func influxEscape(s, chars string) string {
+	if !strings.ContainsAny(s, chars+"\\\n") {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+			continue
+		case r == '\\' || strings.ContainsRune(chars, r):
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// influxLoop writes the metrics gathered from g to InfluxDB every
+// interval, delayed by up to jitter, until ctx is canceled.
+func influxLoop(ctx context.Context, w *influxWriter, interval, jitter time.Duration, g prometheus.Gatherer) {
+	wait := jittered(0, jitter)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		wait = jittered(interval, jitter)
+		pollerCycle("influx")
+
+		log.Println("Writing metrics to InfluxDB")
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := w.Write(reqCtx, g)
+		cancel()
+		if err != nil {
+			log.Printf("influx: %v", err)
+		}
+	}
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,7 +31,10 @@ import (
 	"github.com/mafredri/electrolux_exporter/collector"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/version"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -29,12 +44,98 @@ const (
 	elxOneAppBrand        = "electrolux"
 )
 
+var brands = []string{"electrolux", "aeg"}
+
+// Set by saveClientState, allows alerting if the client state can't be
+// written.
+var clientStateLastWrite = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "client_state",
+	Name:      "last_write_timestamp_seconds",
+	Help:      "Last time the client state file was written successfully, in seconds since epoch",
+})
+
+// Set by runPoller, allows alerting if a background loop (e.g. pushing
+// metrics) has stopped.
+var pollerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "exporter",
+	Name:      "poller_up",
+	Help:      "Background loop is running, by loop",
+}, []string{"loop"})
+
+// Set by pollerCycle on every iteration of a background loop, allows
+// alerting if a loop is running but stuck.
+var pollerLastCycle = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "exporter",
+	Name:      "poller_last_cycle_timestamp_seconds",
+	Help:      "Last time the background loop ran an iteration, in seconds since epoch, by loop",
+}, []string{"loop"})
+
+// Set when starting the background loops that run at a fixed interval,
+// allows alerting on data older than expected.
+var pollInterval = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "exporter",
+	Name:      "poll_interval_seconds",
+	Help:      "Configured interval of the background loop, excluding jitter, by loop",
+}, []string{"loop"})
+
+// Set by runPoller.
+var pollerGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "exporter",
+	Name:      "poller_goroutines",
+	Help:      "Number of background loops running",
+})
+
+// Set at the start of main, allows correlating restarts with gaps in the
+// appliance metrics.
+var startTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "electrolux",
+	Subsystem: "exporter",
+	Name:      "start_time_seconds",
+	Help:      "Time the exporter was started, in seconds since epoch",
+})
+
 // Appended to by envOrDefault.
 var availableEnvs []string
 
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Electrolux Exporter</title></head>
+<body>
+<h1>Electrolux Exporter</h1>
+<p>{{.Version}}</p>
+<p><a href="{{.TelemetryPath}}">Metrics</a></p>
+</body>
+</html>
+`))
+
 func main() {
+	startTime.SetToCurrentTime()
+	// Used by the version collector and landing page, only set at build
+	// time with ldflags.
+	version.Version = exporterVersion()
+
 	// Exporter flags.
-	addr := flag.String("addr", envOrDefault("ELECTROLUX_EXPORTER_ADDR", ":8080"), "Listen on this address")
+	addr := flag.String("addr", envOrDefault("ELECTROLUX_EXPORTER_ADDR", ":8080"), "Listen on these comma-separated addresses, e.g. \":8080\", \"127.0.0.1:8080,[::1]:8080\" or \"unix:/run/electrolux_exporter.sock\" (ignored with systemd socket activation)")
+	once := flag.Bool("once", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_ONCE", "false"))), "Collect metrics once, write them in text format and exit")
+	onceOutput := flag.String("once-output", envOrDefault("ELECTROLUX_EXPORTER_ONCE_OUTPUT", ""), "File to write metrics to with -once (default stdout)")
+	textfileOutput := flag.String("textfile-output", envOrDefault("ELECTROLUX_EXPORTER_TEXTFILE_OUTPUT", ""), "Periodically write metrics to this file for the node_exporter textfile collector instead of serving HTTP (e.g. \"/var/lib/node_exporter/electrolux.prom\")")
+	textfileInterval := flag.Duration("textfile-interval", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_TEXTFILE_INTERVAL", "1m"))), "Interval between writes to the textfile output")
+	pushGatewayURL := flag.String("push-gateway-url", envOrDefault("ELECTROLUX_EXPORTER_PUSH_GATEWAY_URL", ""), "Push metrics to this Prometheus Pushgateway (optional)")
+	pollJitter := flag.Duration("poll-jitter", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_POLL_JITTER", "0s"))), "Random delay of up to this duration before the first and between subsequent textfile writes and Pushgateway pushes, spreads out requests to the OCP API")
+	pushInterval := flag.Duration("push-interval", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_PUSH_INTERVAL", "1m"))), "Interval between pushes to the Pushgateway")
+	influxURL := flag.String("influx-url", envOrDefault("ELECTROLUX_EXPORTER_INFLUX_URL", ""), "Write metrics in line protocol to this InfluxDB v2 server, e.g. \"http://localhost:8086\" (optional)")
+	influxOrg := flag.String("influx-org", envOrDefault("ELECTROLUX_EXPORTER_INFLUX_ORG", ""), "InfluxDB organization")
+	influxBucket := flag.String("influx-bucket", envOrDefault("ELECTROLUX_EXPORTER_INFLUX_BUCKET", "electrolux"), "InfluxDB bucket")
+	influxToken := flag.String("influx-token", envOrDefault("ELECTROLUX_EXPORTER_INFLUX_TOKEN", ""), "InfluxDB API token")
+	influxInterval := flag.Duration("influx-interval", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_INFLUX_INTERVAL", "1m"))), "Interval between writes to InfluxDB")
+	noCollectOnStartup := flag.Bool("no-collect-on-startup", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_NO_COLLECT_ON_STARTUP", "false"))), "Start listening before login, appliance metrics are collected once login succeeds in the background")
+	telemetryPath := flag.String("web.telemetry-path", envOrDefault("ELECTROLUX_EXPORTER_TELEMETRY_PATH", "/metrics"), "Path under which to expose metrics")
+	metricsMaxAge := flag.Duration("metrics-max-age", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_METRICS_MAX_AGE", "0s"))), "Allow caching proxies to serve the metrics response for this long (Cache-Control max-age), 0 disables caching")
 
 	// OCP API flags.
 	apiKey := flag.String("api-key", envOrDefault("ELECTROLUX_EXPORTER_API_KEY", elxOneAppAPIKey), "API key")
@@ -44,18 +145,73 @@ func main() {
 	email := flag.String("email", envOrDefault("ELECTROLUX_EXPORTER_EMAIL", ""), "Email address (required)")
 	password := flag.String("password", envOrDefault("ELECTROLUX_EXPORTER_PASSWORD", ""), "Password (required)")
 	countryCode := flag.String("country", envOrDefault("ELECTROLUX_EXPORTER_COUNTRY_CODE", "FI"), "Country code where the exporter is running (used for API calls)")
+	userAgent := flag.String("user-agent", envOrDefault("ELECTROLUX_EXPORTER_USER_AGENT", "electrolux_exporter/"+exporterVersion()), "User-Agent sent to the OCP API, empty uses the OCP API client default")
+	proxyURL := flag.String("proxy-url", envOrDefault("ELECTROLUX_EXPORTER_PROXY_URL", ""), "HTTP proxy for OCP API requests (default from HTTPS_PROXY)")
+	dialTimeout := flag.Duration("dial-timeout", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_DIAL_TIMEOUT", "30s"))), "Connection timeout for OCP API requests")
+	circuitBreakerThreshold := flag.Int("circuit-breaker-threshold", must(strconv.Atoi(envOrDefault("ELECTROLUX_EXPORTER_CIRCUIT_BREAKER_THRESHOLD", "0"))), "Stop calling the OCP API after this many consecutive failed collections, for -circuit-breaker-cooldown (0 disables)")
+	circuitBreakerCooldown := flag.Duration("circuit-breaker-cooldown", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_CIRCUIT_BREAKER_COOLDOWN", "5m"))), "Time the OCP API isn't called after the circuit breaker opens")
+	reauthAfter := flag.Duration("reauth-after", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_REAUTH_AFTER", "0s"))), "Refresh the token, or log in again if that fails, if fetching appliances has failed for this long, with exponential backoff (0 disables)")
+	configFile := flag.String("config-file", envOrDefault("ELECTROLUX_EXPORTER_CONFIG_FILE", ""), "JSON file with options that are reloaded on SIGHUP: device_types, disabled_metrics and voc_molecular_weight (applied on top of the flags)")
+	accountsFile := flag.String("accounts-file", envOrDefault("ELECTROLUX_EXPORTER_ACCOUNTS_FILE", ""), "JSON file with additional accounts to serve, e.g. for another brand (metrics are labeled by account, the primary account is \"default\")")
+	discoverBrands := flag.Bool("discover-brands", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_DISCOVER_BRANDS", "false"))), "Also serve the appliances of other brands the email is registered with, as additional accounts named by brand")
 	clientStateFile := flag.String("client-state-file", envOrDefault("ELECTROLUX_EXPORTER_CLIENT_STATE_FILE", "electrolux_exporter_client_state.json"), "Path to file where client state is stored (optional)")
 
+	// Dump flags.
+	applianceID := flag.String("appliance-id", "", "Appliance ID to print reported properties for (dump only, default all)")
+
 	// Misc flags.
+	scrapeTimeout := flag.Duration("scrape-timeout", must(time.ParseDuration(envOrDefault("ELECTROLUX_EXPORTER_SCRAPE_TIMEOUT", "30s"))), "Timeout for fetching appliance data from the OCP API")
 	vocMolecularWeight := flag.Float64(
 		"voc-molecular-weight",
 		must(strconv.ParseFloat(envOrDefault("ELECTROLUX_EXPORTER_VOC_MOLECULAR_WEIGHT", "30.026"), 64)),
 		"Molecular weight of gas, in g/mol. Used for TVOC (ppb) conversion VOC density (μg/m^3). Formaldehyde is 30.026 g/mol.",
 	)
+	emitComfort := flag.Bool("emit-comfort", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_EMIT_COMFORT", "false"))), "Emit whether temperature and humidity are within the comfort ranges")
+	comfortTemperature := flag.String("comfort-temperature", envOrDefault("ELECTROLUX_EXPORTER_COMFORT_TEMPERATURE", "20,26"), "Comfortable temperature range in Celsius, as min,max")
+	comfortHumidity := flag.String("comfort-humidity", envOrDefault("ELECTROLUX_EXPORTER_COMFORT_HUMIDITY", "30,60"), "Comfortable relative humidity range in percent, as min,max")
+	emitStateDrift := flag.Bool("emit-state-drift", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_EMIT_STATE_DRIFT", "false"))), "Emit whether desired and reported appliance properties differ")
+	pm25Histogram := flag.Bool("pm25-histogram", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_PM25_HISTOGRAM", "false"))), "Accumulate PM2.5 readings into a (native) histogram")
+	deviceTypes := flag.String("device-types", envOrDefault("ELECTROLUX_EXPORTER_DEVICE_TYPES", ""), "Only collect appliances of these comma-separated device types, e.g. \"AIR_PURIFIER\" (default all supported types)")
+	genericSensors := flag.Bool("generic-sensors", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_GENERIC_SENSORS", "false"))), "Emit sensor metrics (e.g. temperature, PM2.5) for appliances that aren't air purifiers")
+	emitZeroForMissing := flag.Bool("emit-zero-for-missing", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_EMIT_ZERO_FOR_MISSING", "false"))), "Emit 0 for optional properties the appliance has reported before but are now absent, instead of omitting the metric")
+	readingTimestamps := flag.Bool("use-reading-timestamps", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_USE_READING_TIMESTAMPS", "false"))), "Expose appliance readings with the time of the reading instead of the scrape time, not supported with -textfile-output or -push-gateway-url (series go stale in Prometheus if the appliance stops reporting for 5m)")
+	var disabledMetrics stringsFlag
+	if env := envOrDefault("ELECTROLUX_EXPORTER_DISABLE_METRICS", ""); env != "" {
+		disabledMetrics = strings.Split(env, ",")
+	}
+	flag.Var(&disabledMetrics, "disable-metric", "Disable appliance metric by short name, e.g. \"fanspeed_raw\" (repeatable)")
+	metricsIncludeRaw := flag.Bool("metrics-include-raw", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_METRICS_INCLUDE_RAW", "false"))), "Emit the raw and approximate appliance metrics (fanspeed_raw, pm25_approximate), mostly useful for debugging")
+	disableVOCDensity := flag.Bool("disable-voc-density", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_DISABLE_VOC_DENSITY", "false"))), "Disable the VOC density metrics (converted from TVOC using the molecular weight), TVOC in ppb is still emitted")
+	var applianceLabel stringsFlag
+	if env := envOrDefault("ELECTROLUX_EXPORTER_APPLIANCE_LABELS", ""); env != "" {
+		applianceLabel = strings.Split(env, ",")
+	}
+	flag.Var(&applianceLabel, "appliance-label", "Extra label for an appliance's metrics, e.g. \"<appliance-id>:room=bedroom\" (repeatable)")
+	var label stringsFlag
+	if env := envOrDefault("ELECTROLUX_EXPORTER_LABELS", ""); env != "" {
+		label = strings.Split(env, ",")
+	}
+	flag.Var(&label, "label", "Add an appliance attribute as label to the appliance metrics, e.g. \"firmware_version\", or remove a default label, e.g. \"-variant\" (repeatable)")
+	var fanspeedMaxFor stringsFlag
+	if env := envOrDefault("ELECTROLUX_EXPORTER_FANSPEED_MAX_FOR", ""); env != "" {
+		fanspeedMaxFor = strings.Split(env, ",")
+	}
+	flag.Var(&fanspeedMaxFor, "fanspeed-max-for", "Max fan speed for a model or appliance ID, e.g. \"PUREA9=9\" (repeatable)")
+	fanspeedPrecision := flag.Int("fanspeed-precision", must(strconv.Atoi(envOrDefault("ELECTROLUX_EXPORTER_FANSPEED_PRECISION", "2"))), "Number of decimals to round the fan speed ratio to, 0 rounds to an integer, -1 disables rounding")
+	vocDensityMissingTemp := flag.String("voc-density-missing-temp", envOrDefault("ELECTROLUX_EXPORTER_VOC_DENSITY_MISSING_TEMP", "default25"), "Temperature used for the VOC density when the appliance doesn't report one, one of: \"default25\" (25°C), \"skip\" (omit VOC density), \"last\" (last reported temperature)")
+	emitVOCDensityMg := flag.Bool("emit-voc-density-mg", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_EMIT_VOC_DENSITY_MG", "false"))), "Emit VOC density in mg/m^3 in addition to μg/m^3")
+	rawMode := flag.Bool("raw-mode", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_RAW_MODE", "false"))), "Also emit every numeric reported property without conversion as electrolux_appliance_raw{field=\"...\"}, e.g. for reverse-engineering new models")
+	humidityAsPercent := flag.Bool("humidity-as-percent", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_HUMIDITY_AS_PERCENT", "false"))), "Emit relative humidity in percent (0-100) instead of as a ratio (0-1)")
+	pmHumidityCorrection := flag.Float64("pm-humidity-correction", must(strconv.ParseFloat(envOrDefault("ELECTROLUX_EXPORTER_PM_HUMIDITY_CORRECTION", "0"), 64)), "Emit PM2.5 and PM10 corrected for relative humidity using this hygroscopicity κ (e.g. 0.4), 0 disables")
+	emitAQI := flag.Bool("emit-aqi", must(strconv.ParseBool(envOrDefault("ELECTROLUX_EXPORTER_EMIT_AQI", "false"))), "Emit PM2.5 and PM10 converted to US EPA AQI")
+
+	fixtureFile := flag.String("fixture-file", envOrDefault("ELECTROLUX_EXPORTER_FIXTURE_FILE", ""), "Serve appliance metrics from a JSON file of recorded OCP API responses instead of the live API, no login is required (for demos and testing)")
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s [dump]:\n", os.Args[0])
 		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), "\nCommands:\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  dump    Print the reported properties of appliances as JSON and exit\n")
 		fmt.Fprint(flag.CommandLine.Output(), "\nAvailable environment variables:\n")
 		sort.Strings(availableEnvs) // For consistency with flag output.
 		for _, env := range availableEnvs {
@@ -63,38 +219,153 @@ func main() {
 		}
 	}
 
-	flag.Parse()
+	args := os.Args[1:]
+	var dump bool
+	if len(args) > 0 && args[0] == "dump" {
+		dump = true
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args) // Exits on error.
 
-	if *email == "" || *password == "" {
+	if (*email == "" || *password == "") && *fixtureFile == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	var state ocpapi.State
-	if _, err := os.Stat(*clientStateFile); err == nil {
-		log.Printf("Restoring client state from %s", *clientStateFile)
-		f, err := os.Open(*clientStateFile)
-		if err == nil {
-			err = json.NewDecoder(f).Decode(&state)
-			if err != nil {
-				log.Printf("Warning: decode client state: %v", err)
-			} else {
-				log.Println("Client state restored successfully")
-			}
-			f.Close()
-		} else {
-			log.Printf("Warning: open client state file: %v", err)
+	if !slices.Contains(brands, *brand) {
+		log.Fatalf("Error: invalid brand %q, must be one of: %s", *brand, strings.Join(brands, ", "))
+	}
+	if !slices.Contains(countryCodes, *countryCode) {
+		log.Fatalf("Error: invalid country %q, must be an ISO 3166-1 alpha-2 country code (e.g. \"FI\")", *countryCode)
+	}
+
+	if *textfileOutput != "" && *readingTimestamps {
+		log.Fatal("Error: -use-reading-timestamps is not supported with -textfile-output")
+	}
+	// The Pushgateway rejects samples with timestamps.
+	if *pushGatewayURL != "" && *readingTimestamps {
+		log.Fatal("Error: -use-reading-timestamps is not supported with -push-gateway-url")
+	}
+
+	var influx *influxWriter
+	if *influxURL != "" {
+		if *influxOrg == "" {
+			log.Fatal("Error: -influx-org is required with -influx-url")
+		}
+		w, err := newInfluxWriter(*influxURL, *influxOrg, *influxBucket, *influxToken)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		influx = w
+	}
+
+	if !strings.HasPrefix(*telemetryPath, "/") || *telemetryPath == "/healthz" || *telemetryPath == "/refresh" {
+		log.Fatalf("Error: invalid -web.telemetry-path %q, must start with / and not be /healthz or /refresh", *telemetryPath)
+	}
+	if !*metricsIncludeRaw {
+		disabledMetrics = append(disabledMetrics, "fanspeed_raw", "pm25_approximate")
+	}
+	if !slices.Contains([]string{"default25", "skip", "last"}, *vocDensityMissingTemp) {
+		log.Fatalf("Error: invalid -voc-density-missing-temp %q, must be one of: default25, skip, last", *vocDensityMissingTemp)
+	}
+	if *pmHumidityCorrection < 0 {
+		log.Fatalf("Error: invalid -pm-humidity-correction %v, must be positive", *pmHumidityCorrection)
+	}
+	if *disableVOCDensity {
+		disabledMetrics = append(disabledMetrics, "voc_density", "voc_density_mg")
+	}
+	if err := collector.ValidateMolecularWeight(*vocMolecularWeight); err != nil {
+		log.Fatalf("Error: voc molecular weight: %v", err)
+	}
+
+	comfortTemperatureRange, err := parseRange(*comfortTemperature)
+	if err != nil {
+		log.Fatalf("Error: comfort temperature: %v", err)
+	}
+	comfortHumidityRange, err := parseRange(*comfortHumidity)
+	if err != nil {
+		log.Fatalf("Error: comfort humidity: %v", err)
+	}
+
+	fanspeedMax, err := parseFanspeedMax(fanspeedMaxFor)
+	if err != nil {
+		log.Fatalf("Error: fanspeed max: %v", err)
+	}
+
+	labels := parseLabels(label)
+	if err := collector.ValidateLabels(labels); err != nil {
+		log.Fatalf("Error: label: %v", err)
+	}
+
+	applianceLabels, err := parseApplianceLabels(applianceLabel)
+	if err == nil {
+		err = collector.ValidateApplianceLabels(applianceLabels)
+	}
+	if err != nil {
+		log.Fatalf("Error: appliance label: %v", err)
+	}
+
+	if *fixtureFile != "" {
+		// There is no session to persist.
+		*clientStateFile = ""
+		*reauthAfter = 0
+	}
+
+	var accounts []accountConfig
+	if *accountsFile != "" {
+		if dump || *once || *textfileOutput != "" || *fixtureFile != "" {
+			log.Fatal("Error: -accounts-file is only supported when serving metrics")
+		}
+		accounts, err = loadAccounts(*accountsFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *discoverBrands && (dump || *once || *textfileOutput != "" || *fixtureFile != "") {
+		log.Fatal("Error: -discover-brands is only supported when serving metrics")
+	}
+
+	state, restored := restoreClientState(*clientStateFile)
+	if restored != "" {
+		if fi, err := os.Stat(restored); err == nil {
+			clientStateLastWrite.Set(float64(fi.ModTime().UnixNano()) / 1e9)
 		}
 	}
 
-	client, err := ocpapi.New(ocpapi.Config{
+	// The OCP API client doesn't accept a custom HTTP client, but it does
+	// use the default transport. The options only apply to OCP API
+	// requests, see ocpTransport.
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	transport := defaultTransport.Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   *dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil {
+			log.Fatalf("Error: invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	// Must be replaced before the client is created, it keeps a reference
+	// to the default transport.
+	rateLimit := newRateLimitTransport(transport)
+	var ocp http.RoundTripper = rateLimit
+	if *userAgent != "" {
+		ocp = &userAgentTransport{rt: rateLimit, userAgent: *userAgent}
+	}
+	http.DefaultTransport = &ocpTransport{ocp: ocp, rt: defaultTransport}
+
+	config := ocpapi.Config{
 		APIKey:       *apiKey,
 		Brand:        *brand,
 		ClientID:     *clientID,
 		ClientSecret: *clientSecret,
 		CountryCode:  *countryCode,
 		State:        state,
-	})
+	}
+	client, err := ocpapi.New(config)
 	if err != nil {
 		panic(err)
 	}
@@ -102,72 +373,880 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Don't let SIGHUP terminate the exporter (and lose client state),
+	// the config file is reloaded once the collectors are created.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if *discoverBrands {
+		accounts = append(accounts, discoverAccounts(ctx, config, *email, *password, *clientStateFile, accounts)...)
+	}
+
+	var applianceClient collector.ApplianceClient = client
+	if *fixtureFile != "" {
+		log.Printf("Serving appliance data from fixture %s", *fixtureFile)
+		applianceClient, err = loadFixtureClient(*fixtureFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	opts := collector.Options{
+		MolecularWeight: *vocMolecularWeight,
+		ScrapeTimeout:   *scrapeTimeout,
+		EmitAQI:         *emitAQI,
+
+		PMHumidityCorrection: *pmHumidityCorrection,
+
+		EmitVOCDensityMg:  *emitVOCDensityMg,
+		HumidityAsPercent: *humidityAsPercent,
+		RawMode:           *rawMode,
+
+		VOCDensityMissingTemp: *vocDensityMissingTemp,
+
+		FanspeedPrecision: fanspeedPrecision,
+		FanspeedMax:       fanspeedMax,
+
+		EmitComfort:        *emitComfort,
+		ComfortTemperature: comfortTemperatureRange,
+		ComfortHumidity:    comfortHumidityRange,
+
+		EmitStateDrift: *emitStateDrift,
+		PM25Histogram:  *pm25Histogram,
+		GenericSensors: *genericSensors,
+		DeviceTypes:    splitList(*deviceTypes),
+
+		EmitZeroForMissing: *emitZeroForMissing,
+		ReadingTimestamps:  *readingTimestamps,
+
+		DisabledMetrics: disabledMetrics,
+		Labels:          labels,
+		ApplianceLabels: applianceLabels,
+
+		CircuitBreakerThreshold: *circuitBreakerThreshold,
+		CircuitBreakerCooldown:  *circuitBreakerCooldown,
+	}
+	// Options from the config file are reapplied to the flag options on
+	// reload.
+	flagOpts := opts
+	if *configFile != "" {
+		cfg, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		opts = cfg.apply(opts)
+	}
+	collector := collector.NewCollector(applianceClient, &opts)
+
+	// Login in the background is only supported when serving metrics.
+	backgroundLogin := *noCollectOnStartup && !dump && !*once && *textfileOutput == "" && *fixtureFile == ""
+	if !backgroundLogin && *fixtureFile == "" {
+		err = login(ctx, client, *email, *password, collector.ObserveRequestDuration)
+		if err != nil {
+			if errors.Is(err, errLoginRejected) {
+				log.Fatalf("Error: %v", err)
+			}
+			log.Println("Interrupt received, shutting down...")
+			os.Exit(1)
+		}
+	}
+
+	if dump {
+		fetch := func(ctx context.Context) ([]byte, error) {
+			return rawAppliances(ctx, client, *apiKey)
+		}
+		if fc, ok := applianceClient.(*fixtureClient); ok {
+			fetch = func(context.Context) ([]byte, error) {
+				return fc.rawAppliances, nil
+			}
+		}
+		err = dumpReported(ctx, fetch, *applianceID)
+		mustSaveClientState(*clientStateFile, client.State())
+		if err != nil {
+			log.Fatalf("Error: dump: %v", err)
+		}
+		return
+	}
+
+	if *once {
+		reg := prometheus.NewRegistry()
+		// The client state is written after the metrics, the last write
+		// is the one restored on startup.
+		reg.MustRegister(collector, rateLimit, clientStateLastWrite)
+		registerBuildInfo(reg, *brand, *countryCode)
+		err = writeMetrics(*onceOutput, reg)
+		collector.Close()
+		mustSaveClientState(*clientStateFile, client.State())
+		if err != nil {
+			log.Fatalf("Error: write metrics: %v", err)
+		}
+		return
+	}
+
+	if *textfileOutput != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collector, rateLimit, clientStateLastWrite, pollerUp, pollerLastCycle, pollerGoroutines, pollInterval, startTime)
+		registerBuildInfo(reg, *brand, *countryCode)
+		pollInterval.WithLabelValues("textfile").Set(textfileInterval.Seconds())
+		go reloadOnHangup(hup, *configFile, flagOpts, collector, nil)
+		runPoller("textfile", func() {
+			textfileLoop(ctx, *textfileOutput, *textfileInterval, *pollJitter, reg)
+		})
+		collector.Close()
+		mustSaveClientState(*clientStateFile, client.State())
+		return
+	}
+
+	var loggedIn atomic.Bool
+	// The client is replaced when logging in again.
+	reauthTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "electrolux",
+		Name:      "reauth_total",
+		Help:      "Number of forced logins after fetching appliances failed for too long",
+	})
+	tokenRefreshTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "electrolux",
+		Name:      "token_refresh_total",
+		Help:      "Number of forced token refreshes after fetching appliances failed for too long, by result",
+	}, []string{"result"})
+	prometheus.MustRegister(reauthTotal, tokenRefreshTotal, clientStateLastWrite, pollerUp, pollerLastCycle, pollerGoroutines, pollInterval, startTime)
+	prometheus.MustRegister(rateLimit)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "electrolux",
+		Subsystem: "exporter",
+		Name:      "logged_in",
+		Help:      "Login to the OCP API has succeeded and appliance metrics are collected",
+	}, func() float64 {
+		if loggedIn.Load() {
+			return 1
+		}
+		return 0
+	}))
+	// With additional accounts, the metrics of each are labeled by
+	// account to keep them distinct.
+	accountRegisterer := func(r prometheus.Registerer, name string) prometheus.Registerer {
+		if len(accounts) == 0 {
+			return r
+		}
+		return prometheus.WrapRegistererWith(prometheus.Labels{"account": name}, r)
+	}
+	var extraAccounts []*account
+	for _, a := range accounts {
+		acc, err := newAccount(a, config, opts)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		extraAccounts = append(extraAccounts, acc)
+	}
+	go reloadOnHangup(hup, *configFile, flagOpts, collector, extraAccounts)
+	registerBuildInfo(accountRegisterer(prometheus.DefaultRegisterer, "default"), *brand, *countryCode)
+	for _, acc := range extraAccounts {
+		registerBuildInfo(accountRegisterer(prometheus.DefaultRegisterer, acc.config.Name), acc.config.Brand, acc.config.CountryCode)
+	}
+
+	// The collector is registered after login so that appliance metrics
+	// are omitted while login is in progress.
+	loginDone := func() {
+		accountRegisterer(prometheus.DefaultRegisterer, "default").MustRegister(collector)
+		loggedIn.Store(true)
+	}
+	if !backgroundLogin {
+		loginDone()
+	}
+
+	metricsHandler := promhttp.Handler()
+	if *metricsMaxAge > 0 {
+		// Collections aren't cached by the exporter, this allows a
+		// caching proxy to serve multiple scrapers without hitting the
+		// OCP API for each.
+		metricsHandler = maxAgeHandler(metricsHandler, *metricsMaxAge)
+	}
+	http.Handle(*telemetryPath, metricsHandler)
+	// Collections aren't cached, but this allows triggering one and
+	// inspecting the appliance metrics without a scraper.
+	http.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !loggedIn.Load() {
+			http.Error(w, "login in progress", http.StatusServiceUnavailable)
+			return
+		}
+		reg := prometheus.NewRegistry()
+		accountRegisterer(reg, "default").MustRegister(collector)
+		for _, acc := range extraAccounts {
+			if acc.loggedIn.Load() {
+				accountRegisterer(reg, acc.config.Name).MustRegister(acc.collector)
+			}
+		}
+		b, err := renderMetrics(reg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		_, _ = w.Write(b)
+	})
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !loggedIn.Load() {
+			http.Error(w, "login in progress", http.StatusServiceUnavailable)
+			return
+		}
+		// Only authentication errors make the exporter unhealthy, a
+		// restart won't fix network errors or OCP API outages.
+		if err := collector.LastError(); authFailed(err) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	// With metrics served at the root, there's no landing page.
+	if *telemetryPath != "/" {
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err := landingPage.Execute(w, struct {
+				Version       string
+				TelemetryPath string
+			}{
+				Version:       version.Info(),
+				TelemetryPath: *telemetryPath,
+			})
+			if err != nil {
+				log.Printf("landing page: %v", err)
+			}
+		})
+	}
+
+	// All listeners are served by the same server so that they share the
+	// handler and are shut down together.
+	srv := &http.Server{}
+
+	lns, err := listen(strings.Split(*addr, ","))
+	if err != nil {
+		if state, ok := collector.ClientState(); ok && loggedIn.Load() {
+			mustSaveClientState(*clientStateFile, state)
+		}
+		log.Fatalf("Error: listen: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		ln := ln
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stop()
+
+			log.Printf("Listening on %s", ln.Addr())
+			err := srv.Serve(ln)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("serve: %v", err)
+			}
+		}()
+	}
+
+	// Background goroutines that use the client, waited for before the
+	// client state is saved on shutdown.
+	var bg sync.WaitGroup
+	if backgroundLogin {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			if err := login(ctx, client, *email, *password, collector.ObserveRequestDuration); err != nil {
+				if errors.Is(err, errLoginRejected) {
+					log.Fatalf("Error: %v", err)
+				}
+				return
+			}
+			loginDone()
+		}()
+	}
+
+	if *reauthAfter > 0 {
+		relogin := func(ctx context.Context) error {
+			// Try the lighter token refresh before logging in again.
+			// The state is read through the collector, the client may
+			// be refreshing its token in a collection.
+			state, _ := collector.ClientState()
+			refreshed, err := refreshToken(ctx, config, state)
+			if err == nil {
+				tokenRefreshTotal.WithLabelValues("ok").Inc()
+				collector.SetClient(refreshed)
+				state, _ = collector.ClientState()
+				if err := saveClientState(*clientStateFile, state); err != nil {
+					log.Printf("Error: %v", err)
+				}
+				return nil
+			}
+			tokenRefreshTotal.WithLabelValues("fail").Inc()
+			log.Printf("Token refresh failed, logging in: %v", err)
+
+			reauthTotal.Inc()
+			// Login is a noop for a client with a refresh token, so
+			// start over with a new client.
+			cfg := config
+			cfg.State = ocpapi.State{}
+			client, err := ocpapi.New(cfg)
+			if err != nil {
+				return err
+			}
+			err = login(ctx, client, *email, *password, collector.ObserveRequestDuration)
+			if err != nil {
+				return err
+			}
+			collector.SetClient(client)
+			state, _ = collector.ClientState()
+			if err := saveClientState(*clientStateFile, state); err != nil {
+				log.Printf("Error: %v", err)
+			}
+			return nil
+		}
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			runPoller("reauth", func() {
+				reauthLoop(ctx, collector, *reauthAfter, relogin)
+			})
+		}()
+	}
+
+	for _, acc := range extraAccounts {
+		acc := acc
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			if err := login(ctx, acc.client, acc.config.Email, acc.config.Password, acc.collector.ObserveRequestDuration); err != nil {
+				if errors.Is(err, errLoginRejected) {
+					log.Printf("Account %s: %v, not serving its appliances", acc.config.Name, err)
+				}
+				return
+			}
+			accountRegisterer(prometheus.DefaultRegisterer, acc.config.Name).MustRegister(acc.collector)
+			acc.loggedIn.Store(true)
+		}()
+	}
+
+	if *influxURL != "" {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			pollInterval.WithLabelValues("influx").Set(influxInterval.Seconds())
+			runPoller("influx", func() {
+				influxLoop(ctx, influx, *influxInterval, *pollJitter, prometheus.DefaultGatherer)
+			})
+		}()
+	}
+
+	if *pushGatewayURL != "" {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			pollInterval.WithLabelValues("push").Set(pushInterval.Seconds())
+			runPoller("push", func() {
+				pushLoop(ctx, *pushGatewayURL, *pushInterval, *pollJitter)
+			})
+		}()
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	wg.Wait()
+	bg.Wait()
+	// Wait for in-flight collections to finish before reading the state.
+	collector.Close()
+
+	// Avoid overwriting the previous state if login never succeeded.
+	if state, ok := collector.ClientState(); ok && loggedIn.Load() {
+		mustSaveClientState(*clientStateFile, state)
+	}
+	for _, acc := range extraAccounts {
+		acc.collector.Close()
+		if acc.loggedIn.Load() {
+			mustSaveClientState(acc.config.ClientStateFile, acc.client.State())
+		}
+	}
+}
+
+// errLoginRejected is returned by login for errors that retrying won't fix,
+// e.g. a wrong password.
+var errLoginRejected = errors.New("login rejected")
+
+// rejectedLoginStatus matches the OCP API client auth errors caused by an
+// invalid API key, client ID or secret.
+var rejectedLoginStatus = regexp.MustCompile(`unexpected status code for "[^"]*": (400|401|403),`)
+
+// loginRejected returns true if the login error is caused by the
+// configuration (credentials, brand or country) rather than e.g. the
+// network or the OCP API being unavailable.
+//
+// The OCP API client only returns plain error strings, so this depends on
+// the wording of its messages and must be kept in sync when it's updated.
+func loginRejected(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"no identity providers found",         // Unknown email (for brand).
+		"multiple identity providers found",   // Unsupported by ocpapi.
+		"not found in available countries",    // Invalid country code.
+		"gigya login: login: Invalid LoginID", // Wrong email or password.
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return rejectedLoginStatus.MatchString(msg)
+}
+
+// login logs in, retrying with backoff until ctx is canceled. Errors that
+// retrying won't fix are returned immediately, wrapped in errLoginRejected.
+func login(ctx context.Context, client *ocpapi.Client, email, password string, observe func(endpoint string, start time.Time)) error {
 	retryDelay := time.Minute
 	for {
-		log.Printf("Logging in as %s", *email)
+		log.Printf("Logging in as %s", email)
 		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		err = client.Login(reqCtx, *email, *password)
+		start := time.Now()
+		err := client.Login(reqCtx, email, password)
+		observe("login", start)
 		cancel()
 		if err == nil {
-			break
+			return nil
+		}
+		if loginRejected(err) {
+			return fmt.Errorf("%w, check the credentials, brand and country: %v", errLoginRejected, err)
 		}
 		log.Printf("Login failed: %v", err)
 		log.Printf("Retrying in %s...", retryDelay)
 		select {
 		case <-time.After(retryDelay):
 		case <-ctx.Done():
-			log.Println("Interrupt received, shutting down...")
-			os.Exit(1)
+			return ctx.Err()
 		}
+		retryDelay = minDuration(2*retryDelay, 30*time.Minute)
 	}
+}
 
-	prometheus.MustRegister(version.NewCollector("electrolux_exporter"))
-	collector := collector.NewCollector(client, &collector.Options{
-		MolecularWeight: *vocMolecularWeight,
+// refreshToken returns a new client with the user token of state refreshed.
+// The OCP API client only refreshes expired tokens (on request), so the
+// token is marked as expired and refreshed by fetching the appliances.
+func refreshToken(ctx context.Context, config ocpapi.Config, state ocpapi.State) (*ocpapi.Client, error) {
+	if state.UserToken.RefreshToken == "" {
+		return nil, errors.New("refresh token is missing")
+	}
+	state.UserToken.ExpiresAt = time.Time{}
+	config.State = state
+	client, err := ocpapi.New(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if _, err := client.Appliances(ctx, false); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// reauthLoop calls relogin when fetching appliances has failed for at
+// least after. If fetching keeps failing, the time between attempts is
+// doubled (up to a day).
+func reauthLoop(ctx context.Context, c *collector.Collector, after time.Duration, relogin func(context.Context) error) {
+	ticker := time.NewTicker(minDuration(after, time.Minute))
+	defer ticker.Stop()
+
+	wait := after
+	var lastReauth time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		pollerCycle("reauth")
+
+		success, failure := c.LastFetch()
+		if success.After(lastReauth) {
+			wait = after
+		}
+		since := success
+		if lastReauth.After(since) {
+			since = lastReauth
+		}
+		if failure.Before(success) || time.Since(since) < wait {
+			continue
+		}
+		// Logging in again won't help when the OCP API can't be reached.
+		if err := c.LastError(); fetchErrorKind(err) == collector.ErrorKindNetwork {
+			continue
+		}
+
+		log.Printf("Fetching appliances has failed since %s, logging in again...", success.Format(time.RFC3339))
+		lastReauth = time.Now()
+		wait = minDuration(2*wait, 24*time.Hour)
+		if err := relogin(ctx); err != nil {
+			log.Printf("Error: relogin: %v", err)
+		}
+	}
+}
+
+// fetchErrorKind returns the kind of err if it's a *collector.FetchError.
+func fetchErrorKind(err error) collector.ErrorKind {
+	var fetchErr *collector.FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Kind
+	}
+	return collector.ErrorKindUnknown
+}
+
+// authFailed reports whether err is a *collector.FetchError caused by
+// authentication.
+func authFailed(err error) bool {
+	return fetchErrorKind(err) == collector.ErrorKindAuth
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// restoreClientState loads the client state from name, falling back to the
+// backup if it's corrupt. The name of the file restored from is returned,
+// or empty if none.
+func restoreClientState(name string) (state ocpapi.State, restored string) {
+	if name == "" {
+		return state, ""
+	}
+	for _, name := range []string{name, name + ".bak"} {
+		if _, err := os.Stat(name); err != nil {
+			continue
+		}
+		log.Printf("Restoring client state from %s", name)
+		state, err := loadClientState(name)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		log.Println("Client state restored successfully")
+		return state, name
+	}
+	return ocpapi.State{}, ""
+}
+
+func loadClientState(name string) (state ocpapi.State, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return state, fmt.Errorf("open client state file: %w", err)
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&state)
+	if err != nil {
+		return ocpapi.State{}, fmt.Errorf("decode client state: %w", err)
+	}
+	return state, nil
+}
+
+// mustSaveClientState is like saveClientState but exits on error, for use
+// on startup and shutdown.
+func mustSaveClientState(name string, state ocpapi.State) {
+	if err := saveClientState(name, state); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// saveClientState writes the client state to name atomically, the previous
+// state is kept in name.bak (if it could be read). Noop if name is empty.
+func saveClientState(name string, state ocpapi.State) error {
+	if name == "" {
+		return nil
+	}
+	log.Printf("Writing client state to %s", name)
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encode client state: %w", err)
+	}
+	b = append(b, '\n')
+	// Rotated rather than overwritten so that the backup still holds a
+	// good state if the new one turns out to be bad (e.g. revoked tokens).
+	if _, err := loadClientState(name); err == nil {
+		if err := os.Rename(name, name+".bak"); err != nil {
+			log.Printf("Warning: back up client state file: %v", err)
+		}
+	}
+	err = writeFileAtomic(name, b, 0o600)
+	if err != nil {
+		return fmt.Errorf("write client state file: %w", err)
+	}
+	clientStateLastWrite.SetToCurrentTime()
+	log.Println("Client state saved successfully")
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file with permissions perm and
+// renames it to name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Noop after successful rename.
+	err = f.Chmod(perm)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// pushLoop pushes the metrics from the default gatherer to the Pushgateway
+// every interval, delayed by up to jitter, until ctx is canceled.
+func pushLoop(ctx context.Context, url string, interval, jitter time.Duration) {
+	pusher := push.New(url, "electrolux_exporter").Gatherer(prometheus.DefaultGatherer).Client(directClient)
+	if hostname, err := os.Hostname(); err == nil {
+		pusher = pusher.Grouping("instance", hostname)
+	}
+
+	wait := jittered(0, jitter)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		wait = jittered(interval, jitter)
+		pollerCycle("push")
+
+		log.Printf("Pushing metrics to %s", url)
+		reqCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := pusher.PushContext(reqCtx)
+		cancel()
+		if err != nil {
+			log.Printf("push: %v", err)
+		}
+	}
+}
+
+// maxAgeHandler sets the Cache-Control max-age of the responses from h.
+func maxAgeHandler(h http.Handler, maxAge time.Duration) http.Handler {
+	cacheControl := fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		h.ServeHTTP(w, r)
 	})
-	prometheus.MustRegister(collector)
+}
 
-	http.Handle("/metrics", promhttp.Handler())
+// writeMetrics gathers metrics from g and writes them in the text exposition
+// format to the named file, or stdout if name is empty.
+func writeMetrics(name string, g prometheus.Gatherer) error {
+	b, err := renderMetrics(g)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	// Written atomically so that readers (e.g. the node_exporter
+	// textfile collector) never see a partial file.
+	return writeFileAtomic(name, b, 0o644)
+}
 
-	srv := &http.Server{
-		Addr: *addr,
+// renderMetrics gathers the metrics from g in the text exposition format.
+func renderMetrics(g prometheus.Gatherer) ([]byte, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("gather: %w", err)
 	}
 
-	done := make(chan struct{})
-	go func() {
-		defer stop()
-		defer close(done)
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// textfileLoop writes the metrics gathered from g to name every interval,
+// delayed by up to jitter, until ctx is canceled.
+func textfileLoop(ctx context.Context, name string, interval, jitter time.Duration, g prometheus.Gatherer) {
+	wait := jittered(0, jitter)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		wait = jittered(interval, jitter)
+		pollerCycle("textfile")
+
+		log.Printf("Writing metrics to %s", name)
+		if err := writeMetrics(name, g); err != nil {
+			log.Printf("write metrics: %v", err)
+		}
+	}
+}
 
-		log.Printf("Listening on %s", *addr)
-		err := srv.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("listen and serve: %v", err)
+// runPoller runs the background loop f, reporting it as up in pollerUp
+// until it returns. A panic is logged and the loop reported as down rather
+// than crashing the exporter.
+func runPoller(name string, f func()) {
+	up := pollerUp.WithLabelValues(name)
+	up.Set(1)
+	pollerGoroutines.Inc()
+	defer func() {
+		up.Set(0)
+		pollerGoroutines.Dec()
+		if r := recover(); r != nil {
+			log.Printf("Error: %s loop panicked: %v\n%s", name, r, debug.Stack())
 		}
 	}()
+	f()
+}
 
-	<-ctx.Done()
-	log.Println("Shutting down")
+// pollerCycle records an iteration of the named background loop.
+func pollerCycle(name string) {
+	pollerLastCycle.WithLabelValues(name).SetToCurrentTime()
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// jittered returns d plus a random duration in [0, jitter) so that
+// exporters with the same interval don't hit the OCP API in lockstep.
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// dumpReported prints the reported properties of the appliance with the
+// given ID (or all appliances if empty) as JSON to stdout. The properties
+// are printed as returned by fetch, including fields unknown to
+// ocpapi.Reported.
+func dumpReported(ctx context.Context, fetch func(context.Context) ([]byte, error), applianceID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	err = srv.Shutdown(ctx)
+
+	b, err := fetch(ctx)
 	if err != nil {
-		log.Printf("shutdown: %v", err)
+		return fmt.Errorf("appliances: %w", err)
+	}
+	var appliances []struct {
+		ApplianceID string `json:"applianceId"`
+		Properties  struct {
+			Reported json.RawMessage `json:"reported"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(b, &appliances); err != nil {
+		return fmt.Errorf("decode appliances: %w", err)
+	}
+
+	reported := make(map[string]json.RawMessage)
+	for _, appliance := range appliances {
+		if applianceID == "" || appliance.ApplianceID == applianceID {
+			reported[appliance.ApplianceID] = appliance.Properties.Reported
+		}
+	}
+	if applianceID != "" && len(reported) == 0 {
+		return fmt.Errorf("appliance %s not found", applianceID)
 	}
-	<-done
 
-	log.Printf("Writing client state to %s", *clientStateFile)
-	state = client.State()
-	f, err := os.Create(*clientStateFile)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reported)
+}
+
+// rawAppliances fetches the appliances from the OCP API without decoding
+// them, the OCP API client drops the fields it doesn't know about.
+func rawAppliances(ctx context.Context, client *ocpapi.Client, apiKey string) ([]byte, error) {
+	// The client refreshes the token if it has expired, there's no other
+	// way to get a valid token from it.
+	if _, err := client.Appliances(ctx, false); err != nil {
+		return nil, err
+	}
+	state := client.State()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, state.RegionalBaseURL+"/appliance/api/v2/appliances?includeMetadata=true", nil)
 	if err != nil {
-		log.Fatalf("Error: create client state file: %v", err)
+		return nil, err
 	}
-	defer f.Close()
-	err = json.NewEncoder(f).Encode(state)
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("Authorization", state.UserToken.Authorization())
+	req.Header.Set("Accept", "application/json")
+	// Sent through the OCP API transport (proxy, User-Agent, etc.).
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("Error: encode client state: %v", err)
+		return nil, err
 	}
-	log.Println("Client state saved successfully")
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code for %q: %d, body: %s", req.URL.Path, resp.StatusCode, b)
+	}
+	return b, nil
+}
+
+// registerBuildInfo registers the version collector with r, labeled with
+// the OCP API client configuration.
+func registerBuildInfo(r prometheus.Registerer, brand, country string) {
+	r = prometheus.WrapRegistererWith(prometheus.Labels{
+		"brand":          brand,
+		"country":        country,
+		"ocpapi_version": ocpapiVersion(),
+	}, r)
+	r.MustRegister(version.NewCollector("electrolux_exporter"))
+}
+
+// ocpapiVersion returns the module version of the OCP API client
+// compiled into the binary, if known.
+func ocpapiVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == "github.com/mafredri/electrolux-ocp" {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// exporterVersion returns the version set at build time, or the module
+// version (e.g. when installed with go install).
+func exporterVersion() string {
+	if version.Version != "" {
+		return version.Version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return bi.Main.Version
+	}
+	return "unknown"
 }
 
 func must[T any](t T, err error) T {
@@ -177,6 +1256,152 @@ func must[T any](t T, err error) T {
 	return t
 }
 
+// listen returns the sockets passed via systemd socket activation, if any,
+// otherwise it listens on each of addrs (e.g. ":8080", "[::1]:8080" or
+// "unix:/path/to.sock"). If any address fails, the already opened listeners
+// are closed.
+func listen(addrs []string) (lns []net.Listener, err error) {
+	defer func() {
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			lns = nil
+		}
+	}()
+
+	// See sd_listen_fds(3), the first passed file descriptor is 3.
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+		}
+		for fd := 3; fd < 3+n; fd++ {
+			f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+			ln, err := net.FileListener(f)
+			f.Close() // FileListener dups the file descriptor.
+			if err != nil {
+				return lns, fmt.Errorf("socket activation: %w", err)
+			}
+			lns = append(lns, ln)
+		}
+		return lns, nil
+	}
+
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			// Left behind if the exporter wasn't shut down cleanly, the
+			// socket is otherwise removed when the listener is closed.
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			network, addr = "unix", path
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return lns, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseRange parses a range in the form "min,max".
+func parseRange(s string) (r [2]float64, err error) {
+	min, max, ok := strings.Cut(s, ",")
+	if !ok {
+		return r, fmt.Errorf("invalid range %q: want min,max", s)
+	}
+	if r[0], err = strconv.ParseFloat(strings.TrimSpace(min), 64); err != nil {
+		return r, fmt.Errorf("invalid range min: %w", err)
+	}
+	if r[1], err = strconv.ParseFloat(strings.TrimSpace(max), 64); err != nil {
+		return r, fmt.Errorf("invalid range max: %w", err)
+	}
+	if r[0] > r[1] {
+		return r, fmt.Errorf("invalid range %q: min is greater than max", s)
+	}
+	return r, nil
+}
+
+// parseFanspeedMax parses max fan speeds in the form "key=max", where key
+// is a model name or appliance ID.
+func parseFanspeedMax(list []string) (map[string]float64, error) {
+	m := make(map[string]float64)
+	for _, s := range list {
+		key, v, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid value %q: want key=max", s)
+		}
+		max, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max for %s: %w", key, err)
+		}
+		if max <= 0 {
+			return nil, fmt.Errorf("invalid max for %s: must be greater than zero", key)
+		}
+		m[strings.TrimSpace(key)] = max
+	}
+	return m, nil
+}
+
+// parseLabels applies the label additions and removals (prefixed by "-")
+// in list to the default labels.
+func parseLabels(list []string) []string {
+	labels := collector.DefaultLabels()
+	for _, s := range list {
+		if name, ok := strings.CutPrefix(s, "-"); ok {
+			labels = slices.DeleteFunc(labels, func(l string) bool { return l == name })
+			continue
+		}
+		labels = append(labels, s)
+	}
+	return labels
+}
+
+// parseApplianceLabels parses appliance labels in the form
+// "appliance-id:name=value".
+func parseApplianceLabels(list []string) (map[string]map[string]string, error) {
+	m := make(map[string]map[string]string)
+	for _, s := range list {
+		id, label, ok := strings.Cut(s, ":")
+		name, value, ok2 := strings.Cut(label, "=")
+		if !ok || !ok2 || id == "" || name == "" {
+			return nil, fmt.Errorf("invalid value %q: want appliance-id:name=value", s)
+		}
+		if m[id] == nil {
+			m[id] = make(map[string]string)
+		}
+		m[id][name] = value
+	}
+	return m, nil
+}
+
 func envOrDefault(env, def string) string {
 	availableEnvs = append(availableEnvs, env)
 	if v := os.Getenv(env); v != "" {
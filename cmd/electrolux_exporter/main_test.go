@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mafredri/electrolux_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoginRejected(t *testing.T) {
+	// Errors as returned by ocpapi.Client.Login.
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New(`identity providers: do client auth: client token: do: unexpected status code for "/one-account-authorization/api/v1/token": 401, body: {"error":"invalid_client"}`), true},
+		{errors.New(`identity providers: do client auth: unexpected status code for "/one-account-user/api/v1/identity-providers": 403, body: {"message":"Forbidden"}`), true},
+		{errors.New(`identity providers: do client auth: client token: do: unexpected status code for "/one-account-authorization/api/v1/token": 400, body: {"error":"invalid_request"}`), true},
+		{errors.New("no identity providers found"), true},
+		{errors.New("multiple identity providers found, only one is supported: found 2 providers"), true},
+		{errors.New(`country code "XX" not found in available countries: [FI SE]`), true},
+		{errors.New("gigya login: login: Invalid LoginID"), true},
+		{errors.New(`identity providers: do client auth: client token: do: unexpected status code for "/one-account-authorization/api/v1/token": 500, body: `), false},
+		{errors.New(`identity providers: do client auth: unexpected status code for "/one-account-user/api/v1/identity-providers": 429, body: {"message":"Too Many Requests"}`), false},
+		{errors.New(`countries: do client auth: http client do: Get "https://api.eu.ocp.electrolux.one/one-account-user/api/v1/countries": dial tcp: i/o timeout`), false},
+		{errors.New("gigya login: do request: Post \"https://accounts.eu1.gigya.com/accounts.login\": EOF"), false},
+		{fmt.Errorf("identity providers: do client auth: client token: do: http client do: %w", context.DeadlineExceeded), false},
+	}
+	for _, tt := range tests {
+		if got := loginRejected(tt.err); got != tt.want {
+			t.Errorf("loginRejected(%q) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRunPoller(t *testing.T) {
+	var running float64
+	runPoller("test", func() {
+		running = testutil.ToFloat64(pollerGoroutines)
+		if got := testutil.ToFloat64(pollerUp.WithLabelValues("test")); got != 1 {
+			t.Errorf("poller_up = %v, want 1", got)
+		}
+		pollerCycle("test")
+		panic("boom")
+	})
+
+	if running != 1 {
+		t.Errorf("poller_goroutines while running = %v, want 1", running)
+	}
+	if got := testutil.ToFloat64(pollerGoroutines); got != 0 {
+		t.Errorf("poller_goroutines after return = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(pollerUp.WithLabelValues("test")); got != 0 {
+		t.Errorf("poller_up after panic = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(pollerLastCycle.WithLabelValues("test")); got == 0 {
+		t.Error("poller_last_cycle_timestamp_seconds not set")
+	}
+}
+
+func TestReloadableConfigApply(t *testing.T) {
+	base := collector.Options{
+		DeviceTypes:     []string{"AIR_PURIFIER"},
+		DisabledMetrics: []string{"fanspeed_raw"},
+		MolecularWeight: 30.026,
+	}
+	deviceTypes := []string{}
+	molecularWeight := 78.11
+	cfg := reloadableConfig{
+		DeviceTypes:        &deviceTypes,
+		DisabledMetrics:    []string{"tvoc_ppb"},
+		VOCMolecularWeight: &molecularWeight,
+	}
+
+	got := cfg.apply(base)
+	if len(got.DeviceTypes) != 0 || got.MolecularWeight != 78.11 || !reflect.DeepEqual(got.DisabledMetrics, []string{"fanspeed_raw", "tvoc_ppb"}) {
+		t.Errorf("apply() = %+v", got)
+	}
+	if !reflect.DeepEqual(base.DisabledMetrics, []string{"fanspeed_raw"}) {
+		t.Errorf("apply() modified the base options: %v", base.DisabledMetrics)
+	}
+	if got := (reloadableConfig{}).apply(base); !reflect.DeepEqual(got, base) {
+		t.Errorf("empty config apply() = %+v; want %+v", got, base)
+	}
+}
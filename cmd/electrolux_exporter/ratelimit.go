@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateLimitTransport records the rate limit headers of OCP API responses,
+// if any.
+// It's exposed as a collector, metrics are only emitted after the headers
+// have been seen.
+type rateLimitTransport struct {
+	rt http.RoundTripper
+
+	remainingDesc *prometheus.Desc
+	resetDesc     *prometheus.Desc
+
+	mu        sync.Mutex
+	remaining *float64
+	reset     time.Time
+}
+
+var (
+	_ http.RoundTripper    = (*rateLimitTransport)(nil)
+	_ prometheus.Collector = (*rateLimitTransport)(nil)
+)
+
+func newRateLimitTransport(rt http.RoundTripper) *rateLimitTransport {
+	return &rateLimitTransport{
+		rt:            rt,
+		remainingDesc: prometheus.NewDesc("electrolux_ocp_rate_limit_remaining", "Remaining requests in the current OCP API rate limit window, as reported by the API", nil, nil),
+		resetDesc:     prometheus.NewDesc("electrolux_ocp_rate_limit_reset_timestamp_seconds", "Time the OCP API rate limit window resets, in seconds since epoch", nil, nil),
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || !isOCPHost(req.URL.Hostname()) {
+		return resp, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := headerFloat(resp.Header, "X-RateLimit-Remaining", "RateLimit-Remaining"); ok {
+		t.remaining = &v
+	}
+	if v, ok := headerFloat(resp.Header, "X-RateLimit-Reset", "RateLimit-Reset"); ok {
+		// The reset is either a timestamp or the number of seconds until
+		// the window resets (e.g. IETF RateLimit headers).
+		if v > 1e9 {
+			t.reset = time.Unix(int64(v), 0)
+		} else {
+			t.reset = time.Now().Add(time.Duration(v * float64(time.Second)))
+		}
+	}
+	return resp, nil
+}
+
+func (t *rateLimitTransport) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.remainingDesc
+	ch <- t.resetDesc
+}
+
+func (t *rateLimitTransport) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.remaining != nil {
+		ch <- prometheus.MustNewConstMetric(t.remainingDesc, prometheus.GaugeValue, *t.remaining)
+	}
+	if !t.reset.IsZero() {
+		ch <- prometheus.MustNewConstMetric(t.resetDesc, prometheus.GaugeValue, float64(t.reset.Unix()))
+	}
+}
+
+// headerFloat returns the value of the first of names present in h.
+func headerFloat(h http.Header, names ...string) (float64, bool) {
+	for _, name := range names {
+		if s := h.Get(name); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
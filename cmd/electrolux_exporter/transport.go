@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// directClient is used for requests that aren't made to the OCP API
+// (e.g. Pushgateway, InfluxDB), it's unaffected by the OCP API transport
+// options (proxy, dial timeout, etc.).
+var directClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+}
+
+// ocpTransport routes requests for the OCP API and its identity provider
+// to ocp, and all other requests to rt. The OCP API client doesn't accept
+// a custom HTTP client, so this replaces the default transport to keep
+// the OCP API transport options from applying to other requests.
+type ocpTransport struct {
+	ocp http.RoundTripper
+	rt  http.RoundTripper
+}
+
+var _ http.RoundTripper = (*ocpTransport)(nil)
+
+func (t *ocpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isOCPHost(req.URL.Hostname()) || isIdentityHost(req.URL.Hostname()) {
+		return t.ocp.RoundTrip(req)
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// isOCPHost reports whether host is the OCP API or one of its regional
+// hosts (e.g. api.eu.ocp.electrolux.one).
+func isOCPHost(host string) bool {
+	return host == "ocp.electrolux.one" || strings.HasSuffix(host, ".ocp.electrolux.one")
+}
+
+// isIdentityHost reports whether host is the identity provider used to
+// log in to the OCP API (e.g. accounts.eu1.gigya.com).
+func isIdentityHost(host string) bool {
+	return strings.HasSuffix(host, ".gigya.com")
+}
@@ -0,0 +1,18 @@
+package main
+
+import "net/http"
+
+// userAgentTransport overrides the User-Agent of requests, the OCP API
+// client sets its own. Only used for OCP API requests, see ocpTransport.
+type userAgentTransport struct {
+	rt        http.RoundTripper
+	userAgent string
+}
+
+var _ http.RoundTripper = (*userAgentTransport)(nil)
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.rt.RoundTrip(req)
+}
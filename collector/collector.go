@@ -1,42 +1,169 @@
+// Package collector implements a Prometheus collector for Electrolux (and
+// AEG) appliances using the OCP API.
+//
+// The collector can be embedded in other programs. Multiple collectors
+// (e.g. one per account) can be registered as long as their metrics don't
+// collide, e.g. by using prometheus.WrapRegistererWith to add a label:
+//
+//	client, err := ocpapi.New(ocpapi.Config{...})
+//	// Handle err.
+//	err = client.Login(ctx, email, password)
+//	// Handle err.
+//	c := collector.NewCollector(client, &collector.Options{ScrapeTimeout: 10 * time.Second})
+//	defer c.Close()
+//	prometheus.MustRegister(c)
 package collector
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mafredri/electrolux-ocp/ocpapi"
+	"github.com/mafredri/electrolux_exporter/internal/metricutil"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slices"
 )
 
-var labels = []string{
+// infoLabel is an appliance attribute that can be added as a label to the
+// appliance metrics.
+type infoLabel struct {
+	name  string
+	value func(info ocpapi.ApplianceInfo, appliance ocpapi.Appliance) string
+}
+
+// infoLabels are the available appliance labels, in the order they're
+// added to metrics.
+var infoLabels = []infoLabel{
 	// General appliance info.
-	"pnc",
-	"brand",
-	// "market",
-	"product_area",
-	"device_type",
-	// "project",
-	"model",
-	"variant",
-	// "colour",
+	{"pnc", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.PNC }},
+	{"brand", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Brand }},
+	{"market", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Market }},
+	{"product_area", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.ProductArea }},
+	{"device_type", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.DeviceType }},
+	{"project", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Project }},
+	{"model", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Model }},
+	{"variant", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Variant }},
+	{"colour", func(info ocpapi.ApplianceInfo, _ ocpapi.Appliance) string { return info.Colour }},
 
 	// Appliance reported properties.
-	"appliance_id",
-	"name",
-	"model_name",
-	// "firmware_version",
-	// "firmware_version_niu",
-	// "firmware_version_mcu",
-	// "tvoc_brand",
+	{"appliance_id", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string { return a.ApplianceID.String() }},
+	// Serial number of the physical unit, from the appliance ID (PNC,
+	// serial and ELC), empty if the ID is too short.
+	{"serial", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string { return a.ApplianceID.Serial() }},
+	{"name", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string { return a.ApplianceData.ApplianceName }},
+	{"model_name", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string { return a.ApplianceData.ModelName }},
+	// Present on e.g. Pure A9, not on Pure 5000.
+	{"firmware_version", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string {
+		return metricutil.Maybe(a.Properties.Reported.FrmVerNIU)
+	}},
+	{"firmware_version_niu", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string { return a.Properties.Reported.VmNoNIU }},
+	// Present on e.g. Pure 500, not on Pure A9.
+	{"firmware_version_mcu", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string {
+		return metricutil.Maybe(a.Properties.Reported.VmNoMCU)
+	}},
+	{"tvoc_brand", func(_ ocpapi.ApplianceInfo, a ocpapi.Appliance) string {
+		return metricutil.Maybe(a.Properties.Reported.TVOCBrand)
+	}},
+}
+
+var defaultLabels = []string{"pnc", "brand", "product_area", "device_type", "model", "variant", "appliance_id", "name", "model_name"}
+
+// DefaultLabels returns the names of the appliance labels used when
+// Options.Labels is empty.
+func DefaultLabels() []string {
+	return slices.Clone(defaultLabels)
+}
+
+// ValidateLabels returns an error if names (see Options.Labels) contains
+// unknown or duplicate labels, or lacks appliance_id which is required to
+// tell appliances apart.
+func ValidateLabels(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !slices.ContainsFunc(infoLabels, func(l infoLabel) bool { return l.name == name }) {
+			return fmt.Errorf("unknown label %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+	}
+	if !seen["appliance_id"] {
+		return errors.New("label \"appliance_id\" is required")
+	}
+	return nil
 }
 
 const namespace = "electrolux"
 
+const defaultMolecularWeight = 30.026 // Formaldehyde (CH2O).
+
+// maxApplianceLabels limits the number of user-defined appliance labels to
+// keep the cardinality in check.
+const maxApplianceLabels = 5
+
+// forgetApplianceAfter is the number of successful fetches an appliance
+// can be missing from (e.g. removed from the account) before it's no
+// longer reported as down.
+const forgetApplianceAfter = 10
+
+// ValidateApplianceLabels returns an error if the label names in
+// appliance labels (see Options.ApplianceLabels) are invalid, reserved or
+// too many.
+func ValidateApplianceLabels(applianceLabels map[string]map[string]string) error {
+	// Labels used by the collector, including per-metric labels, and the
+	// account label added by the exporter for multiple accounts.
+	reserved := []string{"filter", "property", "mode", "sensor", "code", "field", "account"}
+	for _, l := range infoLabels {
+		reserved = append(reserved, l.name)
+	}
+	names := make(map[string]bool)
+	for id, l := range applianceLabels {
+		for name := range l {
+			switch {
+			case !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__"):
+				return fmt.Errorf("appliance %s: invalid label name %q", id, name)
+			case slices.Contains(reserved, name):
+				return fmt.Errorf("appliance %s: label name %q is reserved", id, name)
+			}
+			names[name] = true
+		}
+	}
+	if len(names) > maxApplianceLabels {
+		return fmt.Errorf("too many appliance label names: %d, max %d", len(names), maxApplianceLabels)
+	}
+	return nil
+}
+
+// ApplianceClient is the subset of the OCP API client used by Collector,
+// it's implemented by *ocpapi.Client.
+type ApplianceClient interface {
+	Appliances(ctx context.Context, includeMetadata bool) ([]ocpapi.Appliance, error)
+	AppliancesInfo(ctx context.Context, applianceIDs ...string) ([]ocpapi.ApplianceInfo, error)
+}
+
+var _ ApplianceClient = (*ocpapi.Client)(nil)
+
+// TODO(mafredri): Backfill recent readings (e.g. PM2.5 over the last few
+// minutes) with their own timestamps, like ReadingTimestamps, once ocpapi
+// supports a history or telemetry endpoint.
+
+// Collector collects appliance metrics from the OCP API on each scrape. It
+// implements prometheus.Collector.
 type Collector struct {
-	client  *ocpapi.Client
+	client  ApplianceClient
 	ctx     context.Context
 	cancel  context.CancelFunc
 	options Options
@@ -44,265 +171,1369 @@ type Collector struct {
 	mu             sync.Mutex
 	applianceInfos map[string]ocpapi.ApplianceInfo
 
-	airPurifierConnected   *prometheus.Desc
-	airPurifierWorkmode    *prometheus.Desc
-	airPurifierDoorOpen    *prometheus.Desc
-	airPurifierUILight     *prometheus.Desc
-	airPurifierSafetyLock  *prometheus.Desc
-	airPurifierIonizer     *prometheus.Desc
-	airPurifierFilterLife  *prometheus.Desc
-	airPurifierFilterType  *prometheus.Desc
-	airPurifierRSSI        *prometheus.Desc
-	airPurifierFanspeed    *prometheus.Desc
-	airPurifierFanspeedMax *prometheus.Desc
-	airPurifierFanspeedRaw *prometheus.Desc
-	airPurifierTemperature *prometheus.Desc
-	airPurifierHumidity    *prometheus.Desc
-	airPurifierPM1         *prometheus.Desc
-	airPurifierPM25        *prometheus.Desc
-	airPurifierPM10        *prometheus.Desc
-	airPurifierCO2         *prometheus.Desc
-	airPurifierTVOC        *prometheus.Desc
-	airPurifierVOCDensity  *prometheus.Desc
+	lastFetchSuccess time.Time
+	lastFetchFailure time.Time
+
+	// Read without the lock, see LastError.
+	lastFetchErr atomic.Pointer[FetchError]
+
+	// Overlapping collections reuse the last fetch instead of
+	// repeating it, see Collect.
+	fetches  atomic.Int64
+	lastSnap *snapshot
+	lastErr  error
+
+	circuitState        *prometheus.Desc
+	consecutiveFailures int
+	circuitOpenedAt     time.Time
+
+	infoLabels          []infoLabel // From Options.Labels.
+	applianceLabelNames []string    // Sorted, from Options.ApplianceLabels.
+
+	descs   []*prometheus.Desc
+	enabled map[*prometheus.Desc]bool
+	byName  map[string]*prometheus.Desc // Keyed by short name, see SetOptions.
+	sensors map[*prometheus.Desc]bool   // Emitted for all device types with GenericSensors.
+
+	labelNames []string // Of the appliance metrics, excluding per-metric labels.
+
+	// Not readings of reported properties, never timestamped with
+	// ReadingTimestamps.
+	notReadings map[*prometheus.Desc]bool
+
+	// Guards descs, Describe doesn't wait for an in-flight collection.
+	descsMu sync.Mutex
+
+	scrapeTimeout *prometheus.Desc
+	inFlight      prometheus.Gauge
+
+	requestDuration *prometheus.HistogramVec
+	skippedTotal    *prometheus.CounterVec
+	collectPanics   prometheus.Counter
+
+	appliancesTotal    *prometheus.Desc
+	applianceInfoError *prometheus.Desc
+	applianceUp        *prometheus.Desc
+	seenAppliances     map[string]int // Keyed by appliance ID, number of fetches missed in a row.
+
+	seenMetrics map[string]map[*prometheus.Desc]bool // Keyed by appliance ID, with EmitZeroForMissing.
+
+	pm25Histogram      *prometheus.HistogramVec
+	pm25LastObservedAt map[string]time.Time // Keyed by appliance ID.
+
+	now           func() time.Time
+	lastConnected map[string]time.Time // Keyed by appliance ID.
+
+	filterLifeSamples map[string][]filterLifeSample // Keyed by appliance ID and filter.
+
+	schemaDrift map[string]bool // Keyed by appliance ID, to log changes.
+
+	lastTemp map[string]int // Keyed by appliance ID, see Options.VOCDensityMissingTemp.
+
+	lastWorkmode    map[string]string  // Keyed by appliance ID.
+	workmodeChanges map[string]float64 // Keyed by appliance ID.
+
+	airPurifierConnected     *prometheus.Desc
+	airPurifierLastConnected *prometheus.Desc
+	airPurifierWorkmode      *prometheus.Desc
+	airPurifierWorkmodeInfo  *prometheus.Desc
+	airPurifierDoorOpen      *prometheus.Desc
+	airPurifierUILight       *prometheus.Desc
+	airPurifierSafetyLock    *prometheus.Desc
+	airPurifierScrapeTime    *prometheus.Desc
+	airPurifierIonizer       *prometheus.Desc
+	airPurifierUV            *prometheus.Desc
+	airPurifierUVRuntime     *prometheus.Desc
+	airPurifierFilterLife    *prometheus.Desc
+	airPurifierFilterType    *prometheus.Desc
+
+	airPurifierFilterReplacement *prometheus.Desc
+
+	airPurifierRSSI          *prometheus.Desc
+	airPurifierWiFiQuality   *prometheus.Desc
+	airPurifierFanspeed      *prometheus.Desc
+	airPurifierFanspeedMax   *prometheus.Desc
+	airPurifierFanspeedRaw   *prometheus.Desc
+	airPurifierTemperature   *prometheus.Desc
+	airPurifierHumidity      *prometheus.Desc
+	airPurifierPM1           *prometheus.Desc
+	airPurifierPM25          *prometheus.Desc
+	airPurifierPM25Approx    *prometheus.Desc
+	airPurifierPM10          *prometheus.Desc
+	airPurifierPM25Corr      *prometheus.Desc
+	airPurifierPM10Corr      *prometheus.Desc
+	airPurifierPM25AQI       *prometheus.Desc
+	airPurifierPM10AQI       *prometheus.Desc
+	airPurifierPM25Hyst      *prometheus.Desc
+	airPurifierCO2           *prometheus.Desc
+	airPurifierTVOC          *prometheus.Desc
+	airPurifierVOCDensity    *prometheus.Desc
+	airPurifierVOCDensityMg  *prometheus.Desc
+	airPurifierComfortOK     *prometheus.Desc
+	airPurifierStateDrift    *prometheus.Desc
+	airPurifierSensorError   *prometheus.Desc
+	airPurifierFault         *prometheus.Desc
+	airPurifierFaultCodeInfo *prometheus.Desc
+
+	airPurifierFirmwareOutdated *prometheus.Desc
+	airPurifierSchemaDrift      *prometheus.Desc
+
+	airPurifierRaw *prometheus.Desc
+
+	airPurifierWorkmodeChanges *prometheus.Desc
 }
 
+// Options configures a Collector, the zero value uses the defaults.
 type Options struct {
-	MolecularWeight float64 // Molecular weight of gas, in g/mol. Used for TVOC ppb conversion to μg/m^3.
+	MolecularWeight float64       // Molecular weight of gas, in g/mol. Used for TVOC ppb conversion to μg/m^3.
+	ScrapeTimeout   time.Duration // Timeout for fetching appliance data from the OCP API, default 30s.
+	EmitAQI         bool          // Emit PM2.5 and PM10 converted to US EPA AQI.
+
+	// PMHumidityCorrection is the hygroscopicity parameter κ used to
+	// correct PM2.5 and PM10 for humidity, see pmHumidityCorrected. Zero
+	// disables the corrected metrics.
+	PMHumidityCorrection float64
+
+	EmitVOCDensityMg bool // Emit VOC density in mg/m^3 in addition to μg/m^3.
+
+	// VOCDensityMissingTemp is the temperature used for the VOC density
+	// when the appliance doesn't report one: "default25" (25°C, the
+	// default), "skip" to omit the VOC density or "last" for the last
+	// temperature reported by the appliance (25°C if none).
+	VOCDensityMissingTemp string
+
+	HumidityAsPercent bool // Emit relative humidity in percent (0-100) instead of as a ratio (0-1).
+
+	// RawMode emits every numeric reported property as is, by field name,
+	// in addition to the other metrics.
+	RawMode bool
+
+	// FanspeedPrecision is the number of decimals the fan speed ratio is
+	// rounded to, default 2 if nil. Zero rounds to an integer, a negative
+	// value disables rounding.
+	FanspeedPrecision *int
+	// FanspeedMax overrides the max fan speed, keyed by appliance ID or
+	// model name (in that order), for models missing from the built-in
+	// table.
+	FanspeedMax map[string]float64
+
+	EmitComfort        bool       // Emit whether temperature and humidity are within the comfort ranges.
+	ComfortTemperature [2]float64 // Comfortable temperature range (min, max) in Celsius, default 20-26.
+	ComfortHumidity    [2]float64 // Comfortable relative humidity range (min, max) in percent, default 30-60.
+
+	EmitStateDrift bool // Emit whether desired and reported properties differ.
+	PM25Histogram  bool // Accumulate PM2.5 readings into a (native) histogram.
+	GenericSensors bool // Emit sensor metrics for appliances that aren't air purifiers.
+
+	// DeviceTypes limits the collected appliances to these device types
+	// (e.g. "AIR_PURIFIER"), default all supported types. Appliances
+	// missing info are always collected.
+	DeviceTypes []string
+
+	// EmitZeroForMissing emits 0 for optional properties that are absent
+	// but have previously been reported by the appliance, instead of
+	// omitting the metric.
+	EmitZeroForMissing bool
+
+	// ReadingTimestamps attaches the time the appliance last reported
+	// its properties to the appliance metrics derived from them (e.g. not
+	// connected or scrape_timestamp_seconds). Prometheus considers series
+	// stale if the timestamp doesn't advance for 5 minutes.
+	ReadingTimestamps bool
+
+	DisabledMetrics []string // Appliance metrics to skip, by short name (e.g. "fanspeed_raw").
+
+	// Labels are the names of the appliance attributes added as labels
+	// to the appliance metrics, DefaultLabels if empty. See
+	// ValidateLabels.
+	Labels []string
+
+	// ApplianceLabels are extra labels added to the metrics of an
+	// appliance, keyed by appliance ID and label name. Appliances without
+	// a label have it set to an empty value. See ValidateApplianceLabels.
+	ApplianceLabels map[string]map[string]string
+
+	// CircuitBreakerThreshold is the number of consecutive failed
+	// fetches after which the circuit opens, collections then skip the
+	// OCP API for CircuitBreakerCooldown (default 5m) before trying
+	// again. Zero disables the circuit breaker.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
 }
 
-func NewCollector(client *ocpapi.Client, opts *Options) *Collector {
+// NewCollector returns a new Collector for the appliances available to
+// client, which must already be logged in. If opts is nil the defaults are
+// used. Close should be called when the collector is no longer used.
+func NewCollector(client ApplianceClient, opts *Options) *Collector {
 	if opts == nil {
 		opts = &Options{}
 	}
 	if opts.MolecularWeight == 0 {
-		opts.MolecularWeight = 30.026 // Formaldehyde (CH2O).
+		opts.MolecularWeight = defaultMolecularWeight
+	}
+	if opts.ScrapeTimeout == 0 {
+		opts.ScrapeTimeout = 30 * time.Second
+	}
+	if opts.FanspeedPrecision == nil {
+		precision := 2
+		opts.FanspeedPrecision = &precision
+	}
+	if opts.CircuitBreakerCooldown == 0 {
+		opts.CircuitBreakerCooldown = 5 * time.Minute
+	}
+	if opts.ComfortTemperature == [2]float64{} {
+		opts.ComfortTemperature = [2]float64{20, 26}
+	}
+	if opts.ComfortHumidity == [2]float64{} {
+		opts.ComfortHumidity = [2]float64{30, 60}
+	}
+	if len(opts.Labels) == 0 {
+		opts.Labels = DefaultLabels()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Collector{
+	c := &Collector{
 		client:  client,
 		ctx:     ctx,
 		cancel:  cancel,
 		options: *opts,
 
 		applianceInfos: make(map[string]ocpapi.ApplianceInfo),
+		enabled:        make(map[*prometheus.Desc]bool),
+		byName:         make(map[string]*prometheus.Desc),
+
+		scrapeTimeout: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "scrape_timeout_seconds"), "Timeout for fetching appliance data from the OCP API", nil, nil),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "collections_in_flight",
+			Help:      "Number of collections running or waiting for a previous one to finish",
+		}),
+
+		skippedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "appliances_skipped_total",
+			Help:      "Number of times an appliance was skipped during collection, by reason",
+		}, []string{"reason"}),
+		collectPanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "collect_panics_total",
+			Help:      "Number of times collecting the metrics for an appliance panicked, e.g. due to an unexpected payload",
+		}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "ocp",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of OCP API requests, by endpoint",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+		}, []string{"endpoint"}),
+
+		appliancesTotal:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "appliances_total"), "Number of appliances on the account, including skipped ones", []string{"device_type"}, nil),
+		applianceInfoError: prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "info_error"), "Appliance info could not be fetched", []string{"appliance_id"}, nil),
+		circuitState:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "ocp", "circuit_state"), "State of the OCP API circuit breaker (0 = closed, 1 = open, 2 = half-open)", nil, nil),
+		applianceUp:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "up"), "Appliance data was fetched successfully in the latest scrape", []string{"appliance_id"}, nil),
+		seenAppliances:     make(map[string]int),
+
+		seenMetrics: make(map[string]map[*prometheus.Desc]bool),
+
+		pm25LastObservedAt: make(map[string]time.Time),
+
+		now:           time.Now,
+		lastConnected: make(map[string]time.Time),
+
+		filterLifeSamples: make(map[string][]filterLifeSample),
+
+		schemaDrift: make(map[string]bool),
+
+		lastTemp: make(map[string]int),
+
+		lastWorkmode:    make(map[string]string),
+		workmodeChanges: make(map[string]float64),
+	}
+	// Considered successful on creation, i.e. after login.
+	c.lastFetchSuccess = c.now()
+
+	var labelNames []string
+	for _, l := range infoLabels {
+		if slices.Contains(opts.Labels, l.name) {
+			c.infoLabels = append(c.infoLabels, l)
+			labelNames = append(labelNames, l.name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, l := range opts.ApplianceLabels {
+		for name := range l {
+			if !seen[name] {
+				seen[name] = true
+				c.applianceLabelNames = append(c.applianceLabelNames, name)
+			}
+		}
+	}
+	sort.Strings(c.applianceLabelNames)
+	labelNames = append(labelNames, c.applianceLabelNames...)
+	c.labelNames = labelNames
+
+	if opts.PM25Histogram {
+		c.pm25Histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                   namespace,
+			Subsystem:                   "appliance",
+			Name:                        "pm25_histogram",
+			Help:                        "Histogram of PM2.5 readings in μg/m^3",
+			Buckets:                     prometheus.ExponentialBuckets(1, 2, 10),
+			NativeHistogramBucketFactor: 1.1,
+		}, labelNames)
+	}
+
+	// desc creates an appliance metric description, all are described
+	// but only the ones that haven't been disabled are collected (see
+	// setDisabled).
+	desc := func(name, help string, extraLabels ...string) *prometheus.Desc {
+		d := prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", name), help, append(labelNames[:len(labelNames):len(labelNames)], extraLabels...), nil)
+		c.descs = append(c.descs, d)
+		c.byName[name] = d
+		return d
+	}
+	c.airPurifierConnected = desc("connected", "Appliance is connected")
+	c.airPurifierScrapeTime = desc("scrape_timestamp_seconds", "Time the exporter fetched the appliance data from the OCP API, in seconds since epoch")
+	c.airPurifierLastConnected = desc("last_connected_timestamp_seconds", "Last scrape time the appliance was connected, in seconds since epoch")
+	c.airPurifierWorkmode = desc("workmode", "Work mode (PowerOff = 0, Manual = 1, Auto = 2, Quiet = 3)")
+	c.airPurifierWorkmodeInfo = desc("workmode_info", "Work mode as reported, by mode", "mode")
+	c.airPurifierWorkmodeChanges = desc("workmode_changes_total", "Number of times the work mode differed from the previously observed one")
+	c.airPurifierDoorOpen = desc("door_open", "Door is open")
+	c.airPurifierUILight = desc("ui_light", "UI light enabled")
+	c.airPurifierSafetyLock = desc("safety_lock", "Safety lock enabled, as reported by the appliance")
+	c.airPurifierIonizer = desc("ionizer", "Ionizer enabled")
+	c.airPurifierUV = desc("uv", "UV light enabled")
+	c.airPurifierUVRuntime = desc("uv_runtime_raw", "UV light runtime as reported by the appliance (raw, unit unknown)")
+	c.airPurifierFilterLife = desc("filter_life", "Filter life remaining, as a ratio (0-1) converted from the reported percentage", "filter")
+	c.airPurifierFilterReplacement = desc("filter_replacement_estimate_timestamp_seconds", "Estimated time the filter life runs out, projected from the filter life changes observed by the exporter, in seconds since epoch", "filter")
+	c.airPurifierFilterType = desc("filter_type_id", "Filter type as numeric ID")
+	c.airPurifierRSSI = desc("rssi", "WiFi signal strength (RSSI) in dBm")
+	c.airPurifierWiFiQuality = desc("wifi_quality_percent", "WiFi signal quality (0-100) derived from RSSI")
+	fanspeedHelp := "Fan speed as a ratio (0-1) of the model's maximum fan speed"
+	if *c.options.FanspeedPrecision >= 0 {
+		fanspeedHelp += fmt.Sprintf(", rounded to %d decimals", *c.options.FanspeedPrecision)
+	}
+	c.airPurifierFanspeed = desc("fanspeed", fanspeedHelp)
+	c.airPurifierFanspeedMax = desc("fanspeed_max", "Maximum fan speed of the model, as a raw value")
+	c.airPurifierFanspeedRaw = desc("fanspeed_raw", "Fan speed as reported (raw)")
+	c.airPurifierTemperature = desc("temperature", "Temperature in Celsius")
+	if c.options.HumidityAsPercent {
+		c.airPurifierHumidity = desc("humidity", "Relative humidity in percent (0-100)")
+	} else {
+		c.airPurifierHumidity = desc("humidity", "Relative humidity, as a ratio (0-1) converted from the reported percentage")
+	}
+	c.airPurifierPM1 = desc("pm1", "PM1 in μg/m^3")
+	c.airPurifierPM25 = desc("pm25", "PM2.5 in μg/m^3")
+	c.airPurifierPM25Approx = desc("pm25_approximate", "Approximate PM2.5 in μg/m^3 (estimated, not measured)")
+	c.airPurifierPM10 = desc("pm10", "PM10 in μg/m^3")
+	c.airPurifierPM25AQI = desc("pm25_aqi", "PM2.5 converted to US EPA AQI")
+	c.airPurifierPM10AQI = desc("pm10_aqi", "PM10 converted to US EPA AQI")
+	c.airPurifierPM25Corr = desc("pm25_corrected", fmt.Sprintf("PM2.5 in μg/m^3, corrected for relative humidity using κ-Köhler theory with κ = %v", c.options.PMHumidityCorrection))
+	c.airPurifierPM10Corr = desc("pm10_corrected", fmt.Sprintf("PM10 in μg/m^3, corrected for relative humidity using κ-Köhler theory with κ = %v", c.options.PMHumidityCorrection))
+	c.airPurifierPM25Hyst = desc("pm25_hysteresis", "Desired PM2.5 hysteresis for auto mode in μg/m^3")
+	c.airPurifierCO2 = desc("co2", "CO2 in ppm, the estimated ECO2 is used if it was reported more recently than CO2")
+	c.airPurifierTVOC = desc("tvoc_ppb", "Total volatile organic compounds in ppb")
+	c.airPurifierVOCDensity = desc("voc_density", vocDensityHelp("μg/m^3", c.options.MolecularWeight))
+	c.airPurifierVOCDensityMg = desc("voc_density_mg", vocDensityHelp("mg/m^3", c.options.MolecularWeight))
+	c.airPurifierStateDrift = desc("state_drift", "Desired and reported property values differ", "property")
+	c.airPurifierSensorError = desc("sensor_error", "Sensor reports an error, by sensor", "sensor")
+	c.airPurifierFirmwareOutdated = desc("firmware_outdated", "Appliance firmware is older than the newest seen on appliances of the same model on the account")
+	c.airPurifierSchemaDrift = desc("schema_drift", "None of the expected properties (e.g. work mode, PM2.5, filter life) could be decoded, the OCP API may have changed")
+	c.airPurifierFault = desc("fault", "Appliance reports an error, see fault_code_info")
+	c.airPurifierFaultCodeInfo = desc("fault_code_info", "Errors reported by the appliance, by code", "code")
+	c.airPurifierRaw = desc("raw", "Numeric reported property as returned by the OCP API, without conversion, by field", "field")
+	c.airPurifierComfortOK = desc("comfort_ok", "Temperature and relative humidity are within the comfort ranges")
+
+	c.sensors = map[*prometheus.Desc]bool{
+		c.airPurifierConnected:     true,
+		c.airPurifierLastConnected: true,
+		c.airPurifierScrapeTime:    true,
+		c.airPurifierRSSI:          true,
+		c.airPurifierWiFiQuality:   true,
+		c.airPurifierTemperature:   true,
+		c.airPurifierHumidity:      true,
+		c.airPurifierComfortOK:     true,
+		c.airPurifierPM1:           true,
+		c.airPurifierPM25:          true,
+		c.airPurifierPM25Approx:    true,
+		c.airPurifierPM10:          true,
+		c.airPurifierPM25AQI:       true,
+		c.airPurifierPM10AQI:       true,
+		c.airPurifierPM25Corr:      true,
+		c.airPurifierPM10Corr:      true,
+		c.airPurifierCO2:           true,
+		c.airPurifierTVOC:          true,
+		c.airPurifierVOCDensity:    true,
+		c.airPurifierVOCDensityMg:  true,
+	}
+
+	c.notReadings = map[*prometheus.Desc]bool{
+		c.airPurifierConnected:         true,
+		c.airPurifierLastConnected:     true,
+		c.airPurifierScrapeTime:        true,
+		c.airPurifierWorkmodeChanges:   true,
+		c.airPurifierFilterReplacement: true,
+		c.airPurifierFirmwareOutdated:  true,
+		c.airPurifierSchemaDrift:       true,
+	}
+
+	c.setDisabled(opts.DisabledMetrics)
+
+	return c
+}
+
+// SetOptions updates the options that can be changed without creating a
+// new collector, e.g. when reloading the configuration: DeviceTypes,
+// DisabledMetrics and MolecularWeight. Other fields are ignored.
+func (c *Collector) SetOptions(opts *Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.options.DeviceTypes = opts.DeviceTypes
+	c.options.DisabledMetrics = opts.DisabledMetrics
+	c.setDisabled(opts.DisabledMetrics)
+
+	molecularWeight := opts.MolecularWeight
+	if molecularWeight == 0 {
+		molecularWeight = defaultMolecularWeight
+	}
+	if molecularWeight != c.options.MolecularWeight {
+		c.options.MolecularWeight = molecularWeight
+		// The molecular weight is part of the help.
+		c.airPurifierVOCDensity = c.redescribe("voc_density", vocDensityHelp("μg/m^3", molecularWeight))
+		c.airPurifierVOCDensityMg = c.redescribe("voc_density_mg", vocDensityHelp("mg/m^3", molecularWeight))
+	}
+}
+
+// setDisabled enables all appliance metrics except the named ones.
+func (c *Collector) setDisabled(names []string) {
+	disabled := make(map[string]bool)
+	for _, name := range names {
+		if c.byName[name] == nil {
+			log.Printf("Warning: cannot disable unknown metric %q", name)
+			continue
+		}
+		disabled[name] = true
+	}
+	for name, d := range c.byName {
+		c.enabled[d] = !disabled[name]
+	}
+}
 
-		airPurifierConnected:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "connected"), "Appliance is connected", labels, nil),
-		airPurifierWorkmode:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "workmode"), "Work mode (PowerOff = 0, Manual = 1, Auto = 2, Quiet = 3)", labels, nil),
-		airPurifierDoorOpen:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "door_open"), "Door is open", labels, nil),
-		airPurifierUILight:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "ui_light"), "UI light enabled", labels, nil),
-		airPurifierSafetyLock:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "safety_lock"), "Safety lock enabled", labels, nil),
-		airPurifierIonizer:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "ionizer"), "Ionizer enabled", labels, nil),
-		airPurifierFilterLife:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "filter_life"), "Filter life remaining", labels, nil),
-		airPurifierFilterType:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "filter_type_id"), "Filter type as numeric ID", labels, nil),
-		airPurifierRSSI:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "rssi"), "WiFi signal strength", labels, nil),
-		airPurifierFanspeed:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "fanspeed"), "Fan speed", labels, nil),
-		airPurifierFanspeedMax: prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "fanspeed_max"), "Maximum fan speed raw value", labels, nil),
-		airPurifierFanspeedRaw: prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "fanspeed_raw"), "Fan speed (raw)", labels, nil),
-		airPurifierTemperature: prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "temperature"), "Temperature in Celsius", labels, nil),
-		airPurifierHumidity:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "humidity"), "Relative humidity", labels, nil),
-		airPurifierPM1:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "pm1"), "PM1 in μg/m^3", labels, nil),
-		airPurifierPM25:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "pm25"), "PM2.5 in μg/m^3", labels, nil),
-		airPurifierPM10:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "pm10"), "PM10 in μg/m^3", labels, nil),
-		airPurifierCO2:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "co2"), "CO2", labels, nil),
-		airPurifierTVOC:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "tvoc_ppb"), "Total volatile organic compounds in ppb", labels, nil),
-		airPurifierVOCDensity:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", "voc_density"), "Volatile organic compound density in μg/m^3)", labels, nil),
+// redescribe replaces the description of the named appliance metric
+// (without per-metric labels) with one using help. The fully-qualified
+// name and labels are unchanged, so it's still considered registered.
+func (c *Collector) redescribe(name, help string) *prometheus.Desc {
+	old := c.byName[name]
+	d := prometheus.NewDesc(prometheus.BuildFQName(namespace, "appliance", name), help, c.labelNames, nil)
+	c.descsMu.Lock()
+	c.descs[slices.Index(c.descs, old)] = d
+	c.descsMu.Unlock()
+	c.byName[name] = d
+	c.enabled[d] = c.enabled[old]
+	delete(c.enabled, old)
+	if c.sensors[old] {
+		c.sensors[d] = true
+		delete(c.sensors, old)
 	}
+	return d
+}
+
+// vocDensityHelp returns the help of the VOC density metric in unit.
+func vocDensityHelp(unit string, molecularWeight float64) string {
+	return fmt.Sprintf("Volatile organic compound density in %s, converted from TVOC ppb using a molecular weight of %v g/mol", unit, molecularWeight)
 }
 
+// Describe implements prometheus.Collector.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.airPurifierConnected
-	ch <- c.airPurifierWorkmode
-	ch <- c.airPurifierDoorOpen
-	ch <- c.airPurifierUILight
-	ch <- c.airPurifierSafetyLock
-	ch <- c.airPurifierIonizer
-	ch <- c.airPurifierFilterLife
-	ch <- c.airPurifierFilterType
-	ch <- c.airPurifierRSSI
-	ch <- c.airPurifierFanspeed
-	ch <- c.airPurifierFanspeedMax
-	ch <- c.airPurifierFanspeedRaw
-	ch <- c.airPurifierTemperature
-	ch <- c.airPurifierHumidity
-	ch <- c.airPurifierPM1
-	ch <- c.airPurifierPM25
-	ch <- c.airPurifierPM10
-	ch <- c.airPurifierCO2
-	ch <- c.airPurifierTVOC
-	ch <- c.airPurifierVOCDensity
-}
-
-var signalStrengthMap = make(map[string]map[int]int)
+	ch <- c.scrapeTimeout
+	ch <- c.inFlight.Desc()
+	c.requestDuration.Describe(ch)
+	c.skippedTotal.Describe(ch)
+	ch <- c.collectPanics.Desc()
+	ch <- c.appliancesTotal
+	ch <- c.applianceInfoError
+	ch <- c.applianceUp
+	ch <- c.circuitState
+	c.descsMu.Lock()
+	descs := slices.Clone(c.descs)
+	c.descsMu.Unlock()
+	for _, d := range descs {
+		ch <- d
+	}
+	if c.pm25Histogram != nil {
+		c.pm25Histogram.Describe(ch)
+	}
+}
 
+// Collect implements prometheus.Collector. Appliance data is fetched from
+// the OCP API, concurrent collections wait for each other and reuse the
+// data fetched while they were waiting to avoid doubling the API load.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	// Read before in-flight is incremented so that a collection
+	// observed as in-flight always sees fetches completed after it.
+	fetches := c.fetches.Load()
+	c.inFlight.Inc()
+	defer c.inFlight.Dec()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	log.Println("Collecting metrics...")
 
-	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
-	defer cancel()
+	ch <- prometheus.MustNewConstMetric(c.scrapeTimeout, prometheus.GaugeValue, c.options.ScrapeTimeout.Seconds())
+	ch <- c.inFlight
+	// Deferred to include the requests made during this collection.
+	defer c.requestDuration.Collect(ch)
+	defer c.skippedTotal.Collect(ch)
+	defer c.collectPanics.Collect(ch)
 
-	appliances, err := c.client.Appliances(ctx, true)
-	if err != nil {
-		log.Printf("Error fetching air purifiers: %v", err)
-		return
+	// Previously seen appliances are reported as down unless their data
+	// is fetched successfully (e.g. if removed from the account).
+	up := make(map[string]bool)
+	for id := range c.seenAppliances {
+		up[id] = false
 	}
+	defer func() {
+		for id, ok := range up {
+			ch <- prometheus.MustNewConstMetric(c.applianceUp, prometheus.GaugeValue, metricutil.BoolToFloat64(ok), id)
+		}
+	}()
 
-	var applianceIDs []string
-	for _, appliance := range appliances {
-		if _, ok := c.applianceInfos[appliance.ApplianceID.PNC()]; !ok {
-			applianceIDs = append(applianceIDs, appliance.ApplianceID.String())
+	// Deferred to report the state after this collection.
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(c.circuitState, prometheus.GaugeValue, float64(c.circuit()))
+	}()
+
+	var snap *snapshot
+	var err error
+	if c.fetches.Load() != fetches {
+		log.Println("Reusing air purifiers fetched by overlapping collection")
+		snap, err = c.lastSnap, c.lastErr
+		if snap == nil {
+			return
+		}
+	} else {
+		if c.circuit() == circuitOpen {
+			log.Println("Circuit open, skipping fetching air purifiers")
+			return
 		}
-	}
 
-	if len(applianceIDs) > 0 {
-		applianceInfo, err := c.client.AppliancesInfo(ctx, applianceIDs...)
-		if err != nil {
-			log.Printf("Error fetching appliance info: %v\n", err)
+		ctx, cancel := context.WithTimeout(c.ctx, c.options.ScrapeTimeout)
+		defer cancel()
+
+		snap, err = c.fetch(ctx)
+		c.lastSnap, c.lastErr = snap, err
+		c.fetches.Add(1)
+		var fetchErr *FetchError
+		errors.As(err, &fetchErr)
+		c.lastFetchErr.Store(fetchErr)
+		if snap == nil {
+			log.Printf("Error fetching air purifiers: %v", err)
+			c.lastFetchFailure = c.now()
+			c.consecutiveFailures++
+			if c.circuit() != circuitClosed {
+				c.circuitOpenedAt = c.now()
+			}
 			return
 		}
+		c.lastFetchSuccess = c.now()
+		c.consecutiveFailures = 0
 
-		for _, info := range applianceInfo {
-			c.applianceInfos[info.PNC] = info
+		for id, missed := range c.seenAppliances {
+			if missed+1 >= forgetApplianceAfter {
+				delete(c.seenAppliances, id)
+				delete(up, id)
+				continue
+			}
+			c.seenAppliances[id] = missed + 1
 		}
 	}
-
+	appliances := snap.appliances
 	for _, appliance := range appliances {
-		info := c.applianceInfos[appliance.ApplianceID.PNC()]
-		reported := appliance.Properties.Reported
-
-		if info.DeviceType != "AIR_PURIFIER" {
-			log.Printf("Skipping appliance %s with device type %s...\n", appliance.ApplianceID, info.DeviceType)
-			continue
+		c.seenAppliances[appliance.ApplianceID.String()] = 0
+		up[appliance.ApplianceID.String()] = false
+	}
+	// Deferred so that the device type is known for newly fetched
+	// appliance info, if missing it's reported as unknown.
+	defer func() {
+		total := make(map[string]int)
+		for _, appliance := range appliances {
+			deviceType := c.applianceInfos[appliance.ApplianceID.PNC()].DeviceType
+			if deviceType == "" {
+				deviceType = "unknown"
+			}
+			total[deviceType]++
+		}
+		for deviceType, n := range total {
+			ch <- prometheus.MustNewConstMetric(c.appliancesTotal, prometheus.GaugeValue, float64(n), deviceType)
 		}
+	}()
 
-		log.Printf("Collecting metrics for appliance %s (%s)...\n", appliance.ApplianceID, appliance.ApplianceData.ApplianceName)
+	if err != nil {
+		// Appliances missing info are still collected, see below.
+		log.Printf("Error fetching appliance info for %s: %v\n", strings.Join(snap.infoErrors, ", "), err)
+	}
 
-		// TODO(mafredri): Define separate metric for appliance_info?
+	for _, appliance := range appliances {
+		_, ok := c.applianceInfos[appliance.ApplianceID.PNC()]
+		if !ok {
+			log.Printf("Missing appliance info for %s\n", appliance.ApplianceID)
+		}
+		up[appliance.ApplianceID.String()] = true
+		ch <- prometheus.MustNewConstMetric(c.applianceInfoError, prometheus.GaugeValue, metricutil.BoolToFloat64(!ok), appliance.ApplianceID.String())
+	}
 
-		labels := []string{
-			info.PNC,
-			info.Brand,
-			// info.Market,
-			info.ProductArea,
-			info.DeviceType,
-			// info.Project,
-			info.Model,
-			info.Variant,
-			// info.Colour,
+	latestFirmware := latestFirmwareByModel(appliances)
 
-			appliance.ApplianceID.String(),
-			appliance.ApplianceData.ApplianceName,
-			appliance.ApplianceData.ModelName,
-			// maybe(reported.FrmVerNIU), // Present on e.g. Pure A9, not on Pure 5000.
-			// reported.VmNoNIU,
-			// maybe(reported.VmNoMCU), // Present on e.g. Pure 500, not on Pure A9.
-			// maybe(reported.TVOCBrand),
+	for _, appliance := range appliances {
+		if !c.collectAppliance(ch, appliance, snap.fetchedAt, latestFirmware) {
+			up[appliance.ApplianceID.String()] = false
 		}
+	}
+
+	if c.pm25Histogram != nil {
+		c.pm25Histogram.Collect(ch)
+	}
+
+	log.Println("Metrics collected.")
+}
 
-		collectMetric := func(desc *prometheus.Desc, v float64) {
-			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+// collectAppliance collects the metrics for appliance. A panic (e.g. on an
+// unexpected payload) is logged and counted, ok is false, so that one
+// appliance doesn't fail the whole collection.
+func (c *Collector) collectAppliance(ch chan<- prometheus.Metric, appliance ocpapi.Appliance, fetchedAt time.Time, latestFirmware map[string]string) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: collecting metrics for appliance %s panicked: %v\n%s", appliance.ApplianceID, r, debug.Stack())
+			c.collectPanics.Inc()
+			ok = false
 		}
-		maybeCollectIntMetric := func(desc *prometheus.Desc, v *int) {
-			if v != nil {
-				collectMetric(desc, float64(*v))
+	}()
+
+	info, hasInfo := c.applianceInfos[appliance.ApplianceID.PNC()]
+	reported := appliance.Properties.Reported
+	desired := appliance.Properties.Desired
+
+	// Without info the device type is unknown, sensor readings are
+	// collected with blank info labels rather than dropped.
+	generic := info.DeviceType != "AIR_PURIFIER"
+	filtered := len(c.options.DeviceTypes) > 0 && !slices.Contains(c.options.DeviceTypes, info.DeviceType)
+	if hasInfo && filtered {
+		log.Printf("Skipping appliance %s with excluded device type %s...\n", appliance.ApplianceID, info.DeviceType)
+		c.skippedTotal.WithLabelValues("excluded").Inc()
+		return true
+	}
+	if hasInfo && generic && !c.options.GenericSensors {
+		log.Printf("Skipping appliance %s with device type %s...\n", appliance.ApplianceID, info.DeviceType)
+		c.skippedTotal.WithLabelValues("device_type").Inc()
+		return true
+	}
+
+	log.Printf("Collecting metrics for appliance %s (%s)...\n", appliance.ApplianceID, appliance.ApplianceData.ApplianceName)
+
+	// TODO(mafredri): Define separate metric for appliance_info?
+
+	var labels []string
+	for _, l := range c.infoLabels {
+		labels = append(labels, l.value(info, appliance))
+	}
+	for _, name := range c.applianceLabelNames {
+		labels = append(labels, c.options.ApplianceLabels[appliance.ApplianceID.String()][name])
+	}
+
+	caps := c.capabilities(reported, desired)
+	if generic {
+		// Only emit sensor readings, other properties may not have
+		// the same meaning for this device type.
+		for desc := range caps {
+			if !c.sensors[desc] {
+				delete(caps, desc)
 			}
 		}
-		maybeCollectBoolMetric := func(desc *prometheus.Desc, v *bool) {
-			if v != nil {
-				collectMetric(desc, float64(boolToFloat64(*v)))
+	}
+	// TODO(mafredri): Expose clock_offset_seconds (device time minus
+	// exporter time) once an appliance reports its local time, only
+	// the desired TimeZoneStandardName is known so far.
+	// NOTE(mafredri): It would be nice to attach the reading timestamp
+	// (reported.Metadata) as an exemplar to e.g. PM2.5 and CO2, but
+	// exemplars are only supported on counters and histograms
+	// (OpenMetrics), wrapping a gauge via NewMetricWithExemplars
+	// fails on Write.
+	collectValue := func(desc *prometheus.Desc, typ prometheus.ValueType, v float64, extraLabels ...string) {
+		if !c.enabled[desc] || !caps[desc] {
+			return
+		}
+		m := prometheus.MustNewConstMetric(desc, typ, v, append(labels[:len(labels):len(labels)], extraLabels...)...)
+		if ts := reported.Metadata.LastUpdated; c.options.ReadingTimestamps && !ts.IsZero() && !c.notReadings[desc] {
+			m = prometheus.NewMetricWithTimestamp(ts, m)
+		}
+		ch <- m
+		if c.options.EmitZeroForMissing {
+			id := appliance.ApplianceID.String()
+			if c.seenMetrics[id] == nil {
+				c.seenMetrics[id] = make(map[*prometheus.Desc]bool)
 			}
+			c.seenMetrics[id][desc] = true
 		}
+	}
+	collectMetric := func(desc *prometheus.Desc, v float64, extraLabels ...string) {
+		collectValue(desc, prometheus.GaugeValue, v, extraLabels...)
+	}
+	// collectMissing emits 0 for an absent optional property that has
+	// previously been reported, the capabilities are bypassed since
+	// they only reflect the current properties.
+	collectMissing := func(desc *prometheus.Desc) {
+		if !c.options.EmitZeroForMissing || !c.enabled[desc] || !c.seenMetrics[appliance.ApplianceID.String()][desc] {
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 0, labels...)
+	}
+	maybeCollectIntMetric := func(desc *prometheus.Desc, v *int) {
+		if f, ok := metricutil.MaybeFloat64(v); ok {
+			collectMetric(desc, f)
+			return
+		}
+		collectMissing(desc)
+	}
+	maybeCollectBoolMetric := func(desc *prometheus.Desc, v *bool) {
+		if f, ok := metricutil.MaybeFloat64(v); ok {
+			collectMetric(desc, f)
+			return
+		}
+		collectMissing(desc)
+	}
 
-		collectMetric(c.airPurifierConnected, boolToFloat64(appliance.ConnectionState == "Connected"))
-		collectMetric(c.airPurifierWorkmode, workmode(reported.Workmode))
-		maybeCollectBoolMetric(c.airPurifierDoorOpen, reported.DoorOpen)
-		maybeCollectBoolMetric(c.airPurifierUILight, &reported.UILight)
-		maybeCollectBoolMetric(c.airPurifierSafetyLock, &reported.SafetyLock)
-		maybeCollectBoolMetric(c.airPurifierIonizer, reported.Ionizer)
+	drift := schemaDrift(reported)
+	if id := appliance.ApplianceID.String(); drift != c.schemaDrift[id] && !generic {
+		c.schemaDrift[id] = drift
+		if drift {
+			log.Printf("Warning: appliance %s (model %s) reported none of the expected properties, the OCP API may have changed, please report the raw properties printed by \"electrolux_exporter dump -appliance-id %s\"", id, appliance.ApplianceData.ModelName, id)
+		}
+	}
+	collectMetric(c.airPurifierSchemaDrift, metricutil.BoolToFloat64(drift))
+	// TODO(mafredri): Expose connection_type_info (e.g. wifi or cloud)
+	// once the OCP API reports the transport, ConnectionState only
+	// distinguishes connected and disconnected.
+	collectMetric(c.airPurifierConnected, metricutil.BoolToFloat64(appliance.ConnectionState == "Connected"))
+	if appliance.ConnectionState == "Connected" {
+		c.lastConnected[appliance.ApplianceID.String()] = c.now()
+	}
+	if t, ok := c.lastConnected[appliance.ApplianceID.String()]; ok {
+		collectMetric(c.airPurifierLastConnected, float64(t.UnixNano())/1e9)
+	}
+	// All appliances are fetched in a single request, overlapping
+	// collections report the time of the fetch they reused.
+	collectMetric(c.airPurifierScrapeTime, float64(fetchedAt.UnixNano())/1e9)
+	collectMetric(c.airPurifierWorkmode, workmode(reported.Workmode))
+	collectMetric(c.airPurifierWorkmodeInfo, 1, reported.Workmode)
+	if id := appliance.ApplianceID.String(); reported.Workmode != "" {
+		if last, ok := c.lastWorkmode[id]; ok && last != reported.Workmode {
+			c.workmodeChanges[id]++
+		}
+		c.lastWorkmode[id] = reported.Workmode
+		collectValue(c.airPurifierWorkmodeChanges, prometheus.CounterValue, c.workmodeChanges[id])
+	}
+	maybeCollectBoolMetric(c.airPurifierDoorOpen, reported.DoorOpen)
+	if codes, ok := faultCodes(reported); ok {
+		collectMetric(c.airPurifierFault, metricutil.BoolToFloat64(len(codes) > 0))
+		for _, code := range codes {
+			collectMetric(c.airPurifierFaultCodeInfo, 1, code)
+		}
+	}
+	// TODO(mafredri): Expose water tank level / tank empty state for
+	// humidifying models once ocpapi.Reported includes those fields.
+	if fw := reported.FrmVerNIU; fw != nil {
+		latest := latestFirmware[appliance.ApplianceData.ModelName]
+		collectMetric(c.airPurifierFirmwareOutdated, metricutil.BoolToFloat64(compareVersions(*fw, latest) < 0))
+	}
+	maybeCollectBoolMetric(c.airPurifierUILight, &reported.UILight)
+	// TODO(mafredri): Expose safety_lock_desired once ocpapi.Desired
+	// includes the safety lock, it's only in the reported state.
+	maybeCollectBoolMetric(c.airPurifierSafetyLock, &reported.SafetyLock)
+	maybeCollectBoolMetric(c.airPurifierIonizer, reported.Ionizer)
+	if reported.UVState != nil {
+		collectMetric(c.airPurifierUV, metricutil.BoolToFloat64(strings.EqualFold(*reported.UVState, "on")))
+	}
+	if reported.UVRuntime != nil {
+		collectMetric(c.airPurifierUVRuntime, float64(*reported.UVRuntime))
+	}
 
-		var filterLife *int
-		switch {
-		case reported.FilterLife1 != nil && reported.FilterLife != nil:
-			if reported.Metadata.FilterLife1.LastUpdated.After(reported.Metadata.FilterLife.LastUpdated) {
-				filterLife = reported.FilterLife1
-			} else {
-				filterLife = reported.FilterLife
-			}
-		case reported.FilterLife1 != nil:
-			filterLife = reported.FilterLife1
-		case reported.FilterLife != nil:
-			filterLife = reported.FilterLife
+	// Filters are tracked independently, e.g. particle and carbon
+	// filter on the Pure A9.
+	collectFilterLife := func(filter string, life *int, meta *ocpapi.ReportedMetadataUpdated) {
+		if life == nil {
+			return
 		}
-		if filterLife != nil {
-			ratio := float64(*filterLife) / 100
-			collectMetric(c.airPurifierFilterLife, ratio)
+		collectMetric(c.airPurifierFilterLife, float64(*life)/100, filter)
+
+		at := c.now()
+		if meta != nil && !meta.LastUpdated.IsZero() {
+			at = meta.LastUpdated
 		}
-		maybeCollectIntMetric(c.airPurifierFilterType, reported.FilterType)
+		key := appliance.ApplianceID.String() + "/" + filter
+		c.filterLifeSamples[key] = addFilterLifeSample(c.filterLifeSamples[key], filterLifeSample{at: at, life: float64(*life)})
+		if t, ok := filterReplacementEstimate(c.filterLifeSamples[key]); ok {
+			collectMetric(c.airPurifierFilterReplacement, float64(t.Unix()), filter)
+		}
+	}
+	collectFilterLife("primary", reported.FilterLife, reported.Metadata.FilterLife)
+	collectFilterLife("secondary", reported.FilterLife1, reported.Metadata.FilterLife1)
+	maybeCollectIntMetric(c.airPurifierFilterType, reported.FilterType)
 
-		maybeCollectIntMetric(c.airPurifierRSSI, reported.RSSI)
-		// collectMetric(c.airPurifierRSSI, signalStrengthToRSSI(reported.SignalStrength))
+	maybeCollectIntMetric(c.airPurifierRSSI, reported.RSSI)
+	if reported.RSSI != nil {
+		collectMetric(c.airPurifierWiFiQuality, wifiQuality(*reported.RSSI))
+	}
+	// collectMetric(c.airPurifierRSSI, signalStrengthToRSSI(reported.SignalStrength))
 
-		if fanspeed, fanspeedMax, ok := fanspeed(appliance.ApplianceData.ModelName, reported.Fanspeed); ok {
-			collectMetric(c.airPurifierFanspeed, round(fanspeed, 2))
-			collectMetric(c.airPurifierFanspeedMax, fanspeedMax)
+	if fanspeed, fanspeedMax, ok := c.fanspeed(appliance.ApplianceID.String(), appliance.ApplianceData.ModelName, reported.Fanspeed); ok {
+		if *c.options.FanspeedPrecision >= 0 {
+			fanspeed = metricutil.Round(fanspeed, *c.options.FanspeedPrecision)
 		}
-		collectMetric(c.airPurifierFanspeedRaw, float64(reported.Fanspeed))
+		collectMetric(c.airPurifierFanspeed, fanspeed)
+		collectMetric(c.airPurifierFanspeedMax, fanspeedMax)
+	}
+	collectMetric(c.airPurifierFanspeedRaw, float64(reported.Fanspeed))
+	// TODO(mafredri): Expose fanspeed_rpm for models that report the
+	// actual fan RPM once ocpapi.Reported includes such a field.
 
-		if reported.Temp != nil {
-			collectMetric(c.airPurifierTemperature, float64(*reported.Temp))
+	maybeCollectIntMetric(c.airPurifierTemperature, reported.Temp)
+	// Sensor error flags, e.g. reported by the Well A7.
+	for sensor, v := range map[string]*bool{
+		"pm25":          reported.ErrPM25,
+		"tvoc":          reported.ErrTVOC,
+		"temp_humidity": reported.ErrTempHumidity,
+	} {
+		if v != nil {
+			collectMetric(c.airPurifierSensorError, metricutil.BoolToFloat64(*v), sensor)
 		}
-		if reported.Humidity != nil {
-			collectMetric(c.airPurifierHumidity, float64(*reported.Humidity)/100)
+	}
+	if reported.Humidity != nil {
+		humidity := float64(*reported.Humidity)
+		if !c.options.HumidityAsPercent {
+			humidity /= 100
 		}
+		collectMetric(c.airPurifierHumidity, humidity)
+	} else {
+		collectMissing(c.airPurifierHumidity)
+	}
+	// TODO(mafredri): Expose target_humidity (as a ratio, like
+	// humidity) for humidifying models once ocpapi.Desired or
+	// ocpapi.Reported includes a target humidity field.
+	if reported.Temp != nil && reported.Humidity != nil {
+		t, rh := float64(*reported.Temp), float64(*reported.Humidity)
+		tr, rhr := c.options.ComfortTemperature, c.options.ComfortHumidity
+		comfortOK := t >= tr[0] && t <= tr[1] && rh >= rhr[0] && rh <= rhr[1]
+		collectMetric(c.airPurifierComfortOK, metricutil.BoolToFloat64(comfortOK))
+	}
 
-		if reported.PM1 != nil {
-			collectMetric(c.airPurifierPM1, float64(*reported.PM1))
+	maybeCollectIntMetric(c.airPurifierPM1, reported.PM1)
+	// The approximate value (e.g. Pure 500) is kept separate so that it
+	// isn't mistaken for a measured reading.
+	maybeCollectIntMetric(c.airPurifierPM25, reported.PM25)
+	maybeCollectIntMetric(c.airPurifierPM25Approx, reported.PM25Approximate)
+	if c.pm25Histogram != nil && reported.PM25 != nil && reported.Metadata.PM25 != nil {
+		// Readings are only observed when scraped, skip those that
+		// have already been observed.
+		id := appliance.ApplianceID.String()
+		if lastUpdated := reported.Metadata.PM25.LastUpdated; lastUpdated.After(c.pm25LastObservedAt[id]) {
+			c.pm25LastObservedAt[id] = lastUpdated
+			c.pm25Histogram.WithLabelValues(labels...).Observe(float64(*reported.PM25))
 		}
+	}
+	maybeCollectIntMetric(c.airPurifierPM10, reported.PM10)
+	// The desired state carries no target fan speed or PM2.5 level, the
+	// hysteresis is the only auto mode setpoint available.
+	maybeCollectIntMetric(c.airPurifierPM25Hyst, desired.PM25Hysteresis)
+	if reported.PM25 != nil {
+		collectMetric(c.airPurifierPM25AQI, aqi(pm25AQIBreakpoints, float64(*reported.PM25)))
+	}
+	if reported.PM10 != nil {
+		collectMetric(c.airPurifierPM10AQI, aqi(pm10AQIBreakpoints, float64(*reported.PM10)))
+	}
+	if reported.PM25 != nil && reported.Humidity != nil {
+		collectMetric(c.airPurifierPM25Corr, pmHumidityCorrected(float64(*reported.PM25), float64(*reported.Humidity), c.options.PMHumidityCorrection))
+	}
+	if reported.PM10 != nil && reported.Humidity != nil {
+		collectMetric(c.airPurifierPM10Corr, pmHumidityCorrected(float64(*reported.PM10), float64(*reported.Humidity), c.options.PMHumidityCorrection))
+	}
+
+	if reported.TVOC != nil {
+		collectMetric(c.airPurifierTVOC, float64(*reported.TVOC))
+	}
+	// The conversion relies on a guess of the molecular weight, skip
+	// it when the VOC density is disabled.
+	if reported.Temp != nil {
+		c.lastTemp[appliance.ApplianceID.String()] = *reported.Temp
+	}
+	if reported.TVOC != nil && (c.enabled[c.airPurifierVOCDensity] || c.enabled[c.airPurifierVOCDensityMg]) {
+		temperature, ok := 25, true
 		switch {
-		case reported.PM25 != nil:
-			collectMetric(c.airPurifierPM25, float64(*reported.PM25))
-		case reported.PM25Approximate != nil:
-			collectMetric(c.airPurifierPM25, float64(*reported.PM25Approximate))
-		}
-		maybeCollectIntMetric(c.airPurifierPM10, reported.PM10)
-
-		if reported.TVOC != nil {
-			collectMetric(c.airPurifierTVOC, float64(*reported.TVOC))
-			temperature := 25
-			if reported.Temp != nil {
-				temperature = *reported.Temp
+		case reported.Temp != nil:
+			temperature = *reported.Temp
+		case c.options.VOCDensityMissingTemp == "skip":
+			ok = false
+		case c.options.VOCDensityMissingTemp == "last":
+			if t, seen := c.lastTemp[appliance.ApplianceID.String()]; seen {
+				temperature = t
 			}
+		}
+		if ok {
 			vocDensity := tvocPPBToVocDensity(*reported.TVOC, temperature, c.options.MolecularWeight)
-			collectMetric(c.airPurifierVOCDensity, round(vocDensity, 2))
+			collectMetric(c.airPurifierVOCDensity, metricutil.Round(vocDensity, 2))
+			collectMetric(c.airPurifierVOCDensityMg, metricutil.Round(vocDensity/1000, 5))
 		}
+	}
+	if reported.TVOC == nil {
+		collectMissing(c.airPurifierTVOC)
+		collectMissing(c.airPurifierVOCDensity)
+		collectMissing(c.airPurifierVOCDensityMg)
+	}
 
-		var co2 *int
-		switch {
-		case reported.CO2 != nil && reported.ECO2 != nil:
-			if reported.Metadata.ECO2.LastUpdated.After(reported.Metadata.CO2.LastUpdated) {
-				co2 = reported.ECO2
-			} else {
-				co2 = reported.CO2
-			}
-		case reported.ECO2 != nil:
+	var co2 *int
+	switch {
+	case reported.CO2 != nil && reported.ECO2 != nil:
+		if reported.Metadata.ECO2.LastUpdated.After(reported.Metadata.CO2.LastUpdated) {
 			co2 = reported.ECO2
-		case reported.CO2 != nil:
+		} else {
 			co2 = reported.CO2
 		}
-		maybeCollectIntMetric(c.airPurifierCO2, co2)
+	case reported.ECO2 != nil:
+		co2 = reported.ECO2
+	case reported.CO2 != nil:
+		co2 = reported.CO2
 	}
+	maybeCollectIntMetric(c.airPurifierCO2, co2)
+	// TODO(mafredri): Expose other gases (e.g. NO2, ozone) once
+	// ocpapi.Reported includes them, converting ppb readings to μg/m^3
+	// like TVOC.
 
-	log.Println("Metrics collected.")
+	// Only the monitoring properties are present in both the desired
+	// and reported state.
+	if drift, ok := stateDrift(desired.Monitoring, reported.Monitoring); ok {
+		collectMetric(c.airPurifierStateDrift, drift, "Monitoring")
+	}
+	if drift, ok := stateDrift(desired.MonitoringStart, reported.MonitoringStart); ok {
+		collectMetric(c.airPurifierStateDrift, drift, "Monitoring_Start")
+	}
+	if drift, ok := stateDrift(desired.MonitoringStop, reported.MonitoringStop); ok {
+		collectMetric(c.airPurifierStateDrift, drift, "Monitoring_Stop")
+	}
+
+	if caps[c.airPurifierRaw] {
+		fields, err := rawFields(reported)
+		if err != nil {
+			log.Printf("Error decoding raw properties for %s: %v\n", appliance.ApplianceID, err)
+		}
+		for _, f := range fields {
+			collectMetric(c.airPurifierRaw, f.value, f.name)
+		}
+	}
+
+	return true
+}
+
+// SetClient replaces the client used for fetching appliance data, e.g.
+// after logging in again.
+func (c *Collector) SetClient(client ApplianceClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+}
+
+// LastError returns the error of the latest fetch as a *FetchError, or nil
+// if it succeeded. Unlike LastFetch, it doesn't wait for an in-flight
+// collection.
+func (c *Collector) LastError() error {
+	if err := c.lastFetchErr.Load(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClientState returns the state of the client (see ocpapi.Client.State),
+// read while no collection is using the client, e.g. refreshing its
+// token. Returns false if the client doesn't have a state.
+func (c *Collector) ClientState() (ocpapi.State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sc, ok := c.client.(interface{ State() ocpapi.State })
+	if !ok {
+		return ocpapi.State{}, false
+	}
+	return sc.State(), true
+}
+
+// LastFetch returns the time appliances were last fetched successfully
+// and the time of the last failure.
+func (c *Collector) LastFetch() (success, failure time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastFetchSuccess, c.lastFetchFailure
+}
+
+// ObserveRequestDuration records the duration of an OCP API request to
+// endpoint (e.g. "login") that started at start. It allows tracking
+// requests made outside of the collector.
+func (c *Collector) ObserveRequestDuration(endpoint string, start time.Time) {
+	c.requestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+// snapshot is the appliance data fetched for a collection.
+type snapshot struct {
+	appliances []ocpapi.Appliance
+	fetchedAt  time.Time
+	infoErrors []string // IDs of appliances whose info could not be fetched.
 }
 
+// TODO(mafredri): Update the snapshot from the OCP websocket stream
+// (IdentityProvider.WebSocketRegionalBaseURL) instead of polling, falling
+// back to fetch when it drops, once ocpapi implements the protocol.
+
+// fetch fetches the appliances and any appliance info that isn't cached
+// yet. The snapshot is nil if the appliances could not be fetched, on
+// appliance info errors it's returned along with the error. Errors are of
+// type *FetchError.
+//
+// If fetching the info in one batch fails, it's retried per appliance so
+// that a single failing appliance doesn't affect the others.
+func (c *Collector) fetch(ctx context.Context) (*snapshot, error) {
+	// NOTE(mafredri): All appliances are fetched in a single request and
+	// the API serves the last reported state, appliances aren't contacted
+	// directly. An appliance on flaky WiFi therefore can't slow down the
+	// request, so there's no per-appliance timeout to apply.
+	start := time.Now()
+	appliances, err := c.client.Appliances(ctx, true)
+	c.ObserveRequestDuration("appliances", start)
+	if err != nil {
+		return nil, newFetchError("appliances", err)
+	}
+	snap := &snapshot{appliances: appliances, fetchedAt: c.now()}
+
+	var applianceIDs []string
+	for _, appliance := range appliances {
+		if _, ok := c.applianceInfos[appliance.ApplianceID.PNC()]; !ok {
+			applianceIDs = append(applianceIDs, appliance.ApplianceID.String())
+		}
+	}
+	if len(applianceIDs) > 0 {
+		start := time.Now()
+		applianceInfo, err := c.client.AppliancesInfo(ctx, applianceIDs...)
+		c.ObserveRequestDuration("appliances_info", start)
+		if err == nil {
+			for _, info := range applianceInfo {
+				c.applianceInfos[info.PNC] = info
+			}
+			return snap, nil
+		}
+
+		// The API doesn't report errors per appliance.
+		var firstErr error
+		for _, id := range applianceIDs {
+			start := time.Now()
+			applianceInfo, err := c.client.AppliancesInfo(ctx, id)
+			c.ObserveRequestDuration("appliances_info", start)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				snap.infoErrors = append(snap.infoErrors, id)
+				continue
+			}
+			for _, info := range applianceInfo {
+				c.applianceInfos[info.PNC] = info
+			}
+		}
+		if firstErr != nil {
+			return snap, newFetchError("appliances info", firstErr)
+		}
+	}
+
+	return snap, nil
+}
+
+// capabilities returns the set of metrics supported by the appliance. The
+// capabilities descriptor reported by the OCP API only describes tasks, so
+// support is instead derived from the reported (and desired) properties of
+// the appliance.
+func (c *Collector) capabilities(reported ocpapi.Reported, desired ocpapi.Desired) map[*prometheus.Desc]bool {
+	caps := map[*prometheus.Desc]bool{
+		c.airPurifierConnected:     true,
+		c.airPurifierLastConnected: true,
+		c.airPurifierScrapeTime:    true,
+		c.airPurifierUILight:       true,
+		c.airPurifierSafetyLock:    true,
+		c.airPurifierFanspeed:      true,
+		c.airPurifierFanspeedMax:   true,
+		c.airPurifierFanspeedRaw:   true,
+	}
+	set := func(desc *prometheus.Desc, ok bool) {
+		if ok {
+			caps[desc] = true
+		}
+	}
+	set(c.airPurifierWorkmode, reported.Workmode != "")
+	set(c.airPurifierWorkmodeInfo, reported.Workmode != "")
+	set(c.airPurifierWorkmodeChanges, reported.Workmode != "")
+	set(c.airPurifierDoorOpen, reported.DoorOpen != nil)
+	set(c.airPurifierIonizer, reported.Ionizer != nil)
+	set(c.airPurifierUV, reported.UVState != nil)
+	set(c.airPurifierUVRuntime, reported.UVRuntime != nil)
+	set(c.airPurifierFilterLife, reported.FilterLife != nil || reported.FilterLife1 != nil)
+	set(c.airPurifierFilterReplacement, reported.FilterLife != nil || reported.FilterLife1 != nil)
+	set(c.airPurifierFilterType, reported.FilterType != nil)
+	set(c.airPurifierRSSI, reported.RSSI != nil)
+	set(c.airPurifierWiFiQuality, reported.RSSI != nil)
+	set(c.airPurifierTemperature, reported.Temp != nil)
+	set(c.airPurifierHumidity, reported.Humidity != nil)
+	set(c.airPurifierPM1, reported.PM1 != nil)
+	set(c.airPurifierPM25, reported.PM25 != nil)
+	set(c.airPurifierPM25Approx, reported.PM25Approximate != nil)
+	set(c.airPurifierPM10, reported.PM10 != nil)
+	set(c.airPurifierPM25AQI, c.options.EmitAQI && reported.PM25 != nil)
+	set(c.airPurifierPM10AQI, c.options.EmitAQI && reported.PM10 != nil)
+	set(c.airPurifierPM25Corr, c.options.PMHumidityCorrection > 0 && reported.PM25 != nil && reported.Humidity != nil)
+	set(c.airPurifierPM10Corr, c.options.PMHumidityCorrection > 0 && reported.PM10 != nil && reported.Humidity != nil)
+	set(c.airPurifierPM25Hyst, desired.PM25Hysteresis != nil)
+	set(c.airPurifierCO2, reported.CO2 != nil || reported.ECO2 != nil)
+	set(c.airPurifierTVOC, reported.TVOC != nil)
+	set(c.airPurifierVOCDensity, reported.TVOC != nil)
+	set(c.airPurifierVOCDensityMg, c.options.EmitVOCDensityMg && reported.TVOC != nil)
+	set(c.airPurifierStateDrift, c.options.EmitStateDrift)
+	set(c.airPurifierSchemaDrift, true)
+	set(c.airPurifierFirmwareOutdated, reported.FrmVerNIU != nil)
+	_, hasFaults := faultCodes(reported)
+	set(c.airPurifierFault, hasFaults)
+	set(c.airPurifierFaultCodeInfo, hasFaults)
+	set(c.airPurifierSensorError, reported.ErrPM25 != nil || reported.ErrTVOC != nil || reported.ErrTempHumidity != nil)
+	set(c.airPurifierComfortOK, c.options.EmitComfort && reported.Temp != nil && reported.Humidity != nil)
+	set(c.airPurifierRaw, c.options.RawMode)
+	return caps
+}
+
+// Circuit breaker states, see Options.CircuitBreakerThreshold.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuit returns the circuit breaker state, once the cooldown has passed
+// the circuit is half-open and the next fetch decides whether it closes or
+// opens again.
+func (c *Collector) circuit() int {
+	switch {
+	case c.options.CircuitBreakerThreshold <= 0 || c.consecutiveFailures < c.options.CircuitBreakerThreshold:
+		return circuitClosed
+	case c.now().Sub(c.circuitOpenedAt) < c.options.CircuitBreakerCooldown:
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// Close cancels any in-flight requests made by the collector and waits for
+// in-flight collections to return, after which the client is no longer
+// used by the collector (unless collected again).
 func (c *Collector) Close() error {
 	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return nil
 }
 
+// schemaDrift returns true if none of the properties reported by all
+// known air purifiers were decoded, suggesting that the OCP API has changed
+// the property names or types.
+func schemaDrift(reported ocpapi.Reported) bool {
+	return reported.Workmode == "" &&
+		reported.FilterLife == nil && reported.FilterLife1 == nil &&
+		reported.PM1 == nil && reported.PM25 == nil && reported.PM10 == nil &&
+		reported.Temp == nil && reported.Humidity == nil &&
+		reported.TVOC == nil && reported.CO2 == nil && reported.ECO2 == nil
+}
+
+type rawField struct {
+	name  string
+	value float64
+}
+
+// rawFields returns the numeric properties in reported by their OCP API
+// field name, sorted. Only the properties known to ocpapi.Reported are
+// included.
+func rawFields(reported ocpapi.Reported) ([]rawField, error) {
+	b, err := json.Marshal(reported)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	var fields []rawField
+	for name, v := range m {
+		if f, ok := v.(float64); ok {
+			fields = append(fields, rawField{name: name, value: f})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields, nil
+}
+
+// faultCodes returns the error properties (by name) that are set in
+// reported, ok is false if the appliance doesn't report any. Some errors are
+// reported as strings, with an unknown set of values, they're considered
+// set unless empty, "false" or "0".
+func faultCodes(reported ocpapi.Reported) (codes []string, ok bool) {
+	for _, e := range []struct {
+		code string
+		v    *bool
+	}{
+		{"ErrPM2_5", reported.ErrPM25},
+		{"ErrTVOC", reported.ErrTVOC},
+		{"ErrTempHumidity", reported.ErrTempHumidity},
+		{"ErrFanMtr", reported.ErrFanMtr},
+		{"ErrCommSensorDisplayBrd", reported.ErrCommSensorDisplayBrd},
+		{"ErrRFID", reported.ErrRFID},
+	} {
+		if e.v != nil {
+			ok = true
+			if *e.v {
+				codes = append(codes, e.code)
+			}
+		}
+	}
+	for _, e := range []struct {
+		code string
+		v    *string
+	}{
+		{"ErrCommSensorUIBrd", reported.ErrCommSensorUIBrd},
+		{"ErrImpellerStuck", reported.ErrImpellerStuck},
+		{"ErrPmNotResp", reported.ErrPmNotResp},
+	} {
+		if e.v != nil {
+			ok = true
+			switch strings.ToLower(*e.v) {
+			case "", "false", "0":
+			default:
+				codes = append(codes, e.code)
+			}
+		}
+	}
+	return codes, ok
+}
+
+// maxFilterLifeSamples limits the filter life changes used for the
+// replacement estimate to the most recent ones.
+const maxFilterLifeSamples = 10
+
+type filterLifeSample struct {
+	at   time.Time
+	life float64 // Percent.
+}
+
+// addFilterLifeSample appends s to samples if the filter life changed. The
+// samples are reset if the filter life increased (i.e. the filter was
+// replaced).
+func addFilterLifeSample(samples []filterLifeSample, s filterLifeSample) []filterLifeSample {
+	if len(samples) > 0 {
+		last := samples[len(samples)-1]
+		switch {
+		case s.life == last.life:
+			return samples
+		case s.life > last.life:
+			samples = nil
+		}
+	}
+	samples = append(samples, s)
+	if len(samples) > maxFilterLifeSamples {
+		samples = samples[len(samples)-maxFilterLifeSamples:]
+	}
+	return samples
+}
+
+// filterReplacementEstimate projects when the filter life reaches zero
+// using a least squares fit of samples, ok is false if there are too few
+// samples or the filter life isn't decreasing.
+func filterReplacementEstimate(samples []filterLifeSample) (t time.Time, ok bool) {
+	if len(samples) < 2 {
+		return time.Time{}, false
+	}
+	// Seconds relative to the first sample, for precision.
+	var meanX, meanY float64
+	for _, s := range samples {
+		meanX += s.at.Sub(samples[0].at).Seconds()
+		meanY += s.life
+	}
+	meanX /= float64(len(samples))
+	meanY /= float64(len(samples))
+	var cov, variance float64
+	for _, s := range samples {
+		dx := s.at.Sub(samples[0].at).Seconds() - meanX
+		cov += dx * (s.life - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return time.Time{}, false
+	}
+	slope := cov / variance // Percent per second.
+	if slope >= 0 {
+		return time.Time{}, false
+	}
+	x := meanX - meanY/slope
+	return samples[0].at.Add(time.Duration(x * float64(time.Second))), true
+}
+
+// latestFirmwareByModel returns the newest firmware version reported by
+// the appliances, by model name.
+func latestFirmwareByModel(appliances []ocpapi.Appliance) map[string]string {
+	latest := make(map[string]string)
+	for _, appliance := range appliances {
+		fw := appliance.Properties.Reported.FrmVerNIU
+		if fw == nil {
+			continue
+		}
+		model := appliance.ApplianceData.ModelName
+		if v, ok := latest[model]; !ok || compareVersions(*fw, v) > 0 {
+			latest[model] = *fw
+		}
+	}
+	return latest
+}
+
+// compareVersions compares dot-separated versions (e.g. "2.1.4"), numeric
+// parts are compared as numbers and others as strings.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		var c int
+		if aErr == nil && bErr == nil {
+			c = an - bn
+		} else {
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			if c < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
 // workmode converts the workmode string to a float64.
 func workmode(s string) float64 {
 	switch s {
@@ -338,6 +1569,12 @@ func signalStrengthToRSSI(s string) float64 {
 	}
 }
 
+// wifiQuality converts RSSI (dBm) to a quality percentage, where -100 dBm
+// or less is 0% and -50 dBm or more is 100%.
+func wifiQuality(rssi int) float64 {
+	return math.Min(math.Max(2*float64(rssi+100), 0), 100)
+}
+
 func fanspeed(model string, speed int) (perc float64, max float64, ok bool) {
 	// Electrolux models are PURE/WELL, AEG models are AX.
 	switch model {
@@ -360,6 +1597,33 @@ func fanspeed(model string, speed int) (perc float64, max float64, ok bool) {
 	return float64(speed) / max, max, true
 }
 
+// fanspeed is like fanspeed but prefers the max fan speed configured for
+// the appliance ID or model via Options.FanspeedMax.
+func (c *Collector) fanspeed(applianceID, model string, speed int) (perc float64, max float64, ok bool) {
+	for _, key := range []string{applianceID, model} {
+		if max, ok := c.options.FanspeedMax[key]; ok && max > 0 {
+			return float64(speed) / max, max, true
+		}
+	}
+	return fanspeed(model, speed)
+}
+
+// ValidateMolecularWeight returns an error if the molecular weight (in
+// g/mol) used for the VOC density conversion is implausible. VOCs range from
+// e.g. methanol (32 g/mol) to siloxanes (~450 g/mol), bounds are generous.
+func ValidateMolecularWeight(molecularWeight float64) error {
+	const min, max = 10, 1000
+	if !(molecularWeight >= min && molecularWeight <= max) {
+		return fmt.Errorf("molecular weight %v g/mol is out of range [%d, %d]", molecularWeight, min, max)
+	}
+	// 1000 ppb at 25°C, i.e. ~40.9 μg/m^3 per g/mol.
+	d := tvocPPBToVocDensity(1000, 25, molecularWeight)
+	if math.IsNaN(d) || d < 40*min || d > 41*max {
+		return fmt.Errorf("VOC density conversion self-test failed: 1000 ppb at 25°C = %v μg/m^3 for %v g/mol", d, molecularWeight)
+	}
+	return nil
+}
+
 // tvocPPBToVocDensity converts TVOC in parts per billion (ppb) to VOC density
 // (μg/m^3). This function is based on the following formula:
 //
@@ -376,22 +1640,70 @@ func tvocPPBToVocDensity(ppb, temperature int, molecularWeight float64) float64
 	return (101.325 * molecularWeight * float64(ppb)) / (8.31446261815324 * (273.15 + float64(temperature)))
 }
 
-func round(f float64, decimals int) float64 {
-	shift := math.Pow(10, float64(decimals))
-	return math.Round(f*shift) / shift
+// stateDrift returns 1 if the desired and reported values differ, ok is
+// false unless both are present.
+func stateDrift[T comparable](desired, reported *T) (drift float64, ok bool) {
+	if desired == nil || reported == nil {
+		return 0, false
+	}
+	return metricutil.BoolToFloat64(*desired != *reported), true
 }
 
-func boolToFloat64(b bool) float64 {
-	if b {
-		return 1
+// aqiBreakpoint maps a concentration range (μg/m^3) to an AQI range.
+type aqiBreakpoint struct {
+	cLow, cHigh float64
+	iLow, iHigh float64
+}
+
+// US EPA AQI breakpoints (2024 revision for PM2.5).
+var (
+	pm25AQIBreakpoints = []aqiBreakpoint{
+		{0, 9.0, 0, 50},
+		{9.1, 35.4, 51, 100},
+		{35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200},
+		{125.5, 225.4, 201, 300},
+		{225.5, 325.4, 301, 500},
 	}
-	return 0
+	pm10AQIBreakpoints = []aqiBreakpoint{
+		{0, 54, 0, 50},
+		{55, 154, 51, 100},
+		{155, 254, 101, 150},
+		{255, 354, 151, 200},
+		{355, 424, 201, 300},
+		{425, 604, 301, 500},
+	}
+)
+
+// aqi converts the concentration to AQI via piecewise-linear interpolation
+// between breakpoints. Concentrations above the last breakpoint are
+// extrapolated from it.
+func aqi(breakpoints []aqiBreakpoint, c float64) float64 {
+	bp := breakpoints[len(breakpoints)-1]
+	for _, b := range breakpoints {
+		if c <= b.cHigh {
+			bp = b
+			break
+		}
+	}
+	if c < bp.cLow { // In between ranges, e.g. 9.05.
+		c = bp.cLow
+	}
+	return math.Round((bp.iHigh-bp.iLow)/(bp.cHigh-bp.cLow)*(c-bp.cLow) + bp.iLow)
 }
 
-func maybe[T any](s *T) T {
-	var empty T
-	if s == nil {
-		return empty
+// pmHumidityCorrected corrects the particulate matter concentration pm for
+// the water absorbed by particles at relative humidity rh (in percent),
+// which low-cost optical sensors count as particle mass. The mass growth
+// factor is from κ-Köhler theory (Crilley et al. 2018):
+//
+//	corrected = pm / (1 + (κ/1.65) / (1/aw - 1)), aw = rh/100
+//
+// The humidity is capped at 99% since the factor diverges at saturation.
+func pmHumidityCorrected(pm, rh, kappa float64) float64 {
+	if rh <= 0 {
+		return pm
 	}
-	return *s
+	aw := math.Min(rh, 99) / 100
+	return pm / (1 + (kappa/1.65)/(1/aw-1))
 }
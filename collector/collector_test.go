@@ -0,0 +1,1155 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mafredri/electrolux-ocp/ocpapi"
+	"github.com/mafredri/electrolux_exporter/internal/metricutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/exp/slices"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+type fakeClient struct {
+	appliances     []ocpapi.Appliance
+	applianceInfos []ocpapi.ApplianceInfo
+	err            error           // Returned by Appliances, if set.
+	infoErr        map[string]bool // Appliance IDs for which AppliancesInfo fails.
+	started        chan struct{}   // If set, Appliances signals it and blocks until canceled.
+	calls          int             // Number of Appliances calls.
+
+	blocked chan struct{} // If set, Appliances signals it and blocks until unblock is closed.
+	unblock chan struct{}
+
+	canceled atomic.Bool // Set when Appliances returns after started.
+}
+
+var _ ApplianceClient = (*fakeClient)(nil)
+
+func (f *fakeClient) Appliances(ctx context.Context, includeMetadata bool) ([]ocpapi.Appliance, error) {
+	f.calls++
+	if f.blocked != nil {
+		f.blocked <- struct{}{}
+		<-f.unblock
+	}
+	if f.started != nil {
+		close(f.started)
+		<-ctx.Done()
+		f.canceled.Store(true)
+		return nil, ctx.Err()
+	}
+	return f.appliances, f.err
+}
+
+func (f *fakeClient) AppliancesInfo(ctx context.Context, applianceIDs ...string) ([]ocpapi.ApplianceInfo, error) {
+	for _, id := range applianceIDs {
+		if f.infoErr[id] {
+			return nil, errors.New("appliance info failed")
+		}
+	}
+	var infos []ocpapi.ApplianceInfo
+	for _, info := range f.applianceInfos {
+		for _, id := range applianceIDs {
+			if ocpapi.ApplianceID(id).PNC() == info.PNC {
+				infos = append(infos, info)
+				break
+			}
+		}
+	}
+	return infos, nil
+}
+
+func loadFakeClient(t *testing.T, name string) *fakeClient {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture struct {
+		Appliances     []ocpapi.Appliance     `json:"appliances"`
+		ApplianceInfos []ocpapi.ApplianceInfo `json:"applianceInfos"`
+	}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeClient{
+		appliances:     fixture.Appliances,
+		applianceInfos: fixture.ApplianceInfos,
+	}
+}
+
+// gatherAppliance returns the appliance metrics gathered from c in the
+// text exposition format.
+func gatherAppliance(t *testing.T, c prometheus.Collector) []byte {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		// Skip e.g. build info, it depends on the test binary.
+		if !strings.HasPrefix(mf.GetName(), namespace+"_appliance_") {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestCollectorGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+	}{
+		{name: "pure_a9"},
+		{name: "aeg_ax7", opts: &Options{EmitVOCDensityMg: true}},
+		{name: "well_a7"},
+		{name: "generic_sensors", opts: &Options{GenericSensors: true}},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		t.Run(name, func(t *testing.T) {
+			c := NewCollector(loadFakeClient(t, name+".json"), tt.opts)
+			defer c.Close()
+			c.now = func() time.Time { return time.Date(2023, 8, 17, 20, 1, 0, 0, time.UTC) }
+
+			got := gatherAppliance(t, c)
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("metrics mismatch (-update to regenerate)\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCollectorMultiple(t *testing.T) {
+	a := NewCollector(loadFakeClient(t, "pure_a9.json"), nil)
+	defer a.Close()
+	b := NewCollector(loadFakeClient(t, "aeg_ax7.json"), nil)
+	defer b.Close()
+
+	// Gather twice so that state kept between scrapes (e.g. seen
+	// appliances) is exercised.
+	for i := 0; i < 2; i++ {
+		gotA := string(gatherAppliance(t, a))
+		gotB := string(gatherAppliance(t, b))
+		if !strings.Contains(gotA, "950011538111111115087076") || strings.Contains(gotA, "950011716222222225087076") {
+			t.Errorf("gather %d: collector a reported wrong appliances:\n%s", i, gotA)
+		}
+		if !strings.Contains(gotB, "950011716222222225087076") || strings.Contains(gotB, "950011538111111115087076") {
+			t.Errorf("gather %d: collector b reported wrong appliances:\n%s", i, gotB)
+		}
+	}
+}
+
+func TestCollectorApplianceLabels(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		ApplianceLabels: map[string]map[string]string{
+			"950011538111111115087076": {"room": "bedroom"},
+			"other":                    {"zone": "upstairs"},
+		},
+	})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	if !strings.Contains(got, `,room="bedroom",variant="PA91-606DG",zone=""}`) {
+		t.Errorf("appliance labels missing:\n%s", got)
+	}
+}
+
+func TestValidateApplianceLabels(t *testing.T) {
+	tests := []struct {
+		labels  map[string]string
+		wantErr bool
+	}{
+		{labels: map[string]string{"room": "bedroom", "floor": "1"}},
+		{labels: map[string]string{"1room": "bedroom"}, wantErr: true},
+		{labels: map[string]string{"__room": "bedroom"}, wantErr: true},
+		{labels: map[string]string{"model": "mine"}, wantErr: true},
+		{labels: map[string]string{"filter": "hepa"}, wantErr: true},
+		{labels: map[string]string{"a": "", "b": "", "c": "", "d": "", "e": "", "f": ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := ValidateApplianceLabels(map[string]map[string]string{"id": tt.labels})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateApplianceLabels(%v) error = %v; want error %t", tt.labels, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCollectorLabels(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		Labels: []string{"firmware_version", "appliance_id", "model"},
+	})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	want := `electrolux_appliance_connected{appliance_id="950011538111111115087076",firmware_version="3.0.1",model="PUREA9"} 1`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+
+	c = NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		Labels: []string{"appliance_id", "serial"},
+	})
+	defer c.Close()
+
+	got = string(gatherAppliance(t, c))
+	want = `electrolux_appliance_connected{appliance_id="950011538111111115087076",serial="11111111"} 1`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		names   []string
+		wantErr bool
+	}{
+		{names: DefaultLabels()},
+		{names: []string{"appliance_id", "firmware_version", "colour"}},
+		{names: []string{"appliance_id", "room"}, wantErr: true},
+		{names: []string{"appliance_id", "model", "model"}, wantErr: true},
+		{names: []string{"pnc", "name"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := ValidateLabels(tt.names)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateLabels(%v) error = %v; want error %t", tt.names, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCollectorCircuitBreaker(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	client.err = errors.New("network down")
+	c := NewCollector(client, &Options{
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  time.Minute,
+	})
+	defer c.Close()
+	now := time.Date(2023, 8, 17, 20, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	circuitState := func() float64 {
+		t.Helper()
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == namespace+"_ocp_circuit_state" {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatal("circuit state not found")
+		return 0
+	}
+
+	steps := []struct {
+		name      string
+		advance   time.Duration
+		err       error
+		want      float64
+		wantCalls int
+	}{
+		{name: "first failure", err: client.err, want: circuitClosed, wantCalls: 1},
+		{name: "threshold reached", err: client.err, want: circuitOpen, wantCalls: 2},
+		{name: "open", err: nil, want: circuitOpen, wantCalls: 2},
+		{name: "half-open failure", advance: time.Minute, err: client.err, want: circuitOpen, wantCalls: 3},
+		{name: "half-open success", advance: time.Minute, err: nil, want: circuitClosed, wantCalls: 4},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		client.err = step.err
+		if got := circuitState(); got != step.want || client.calls != step.wantCalls {
+			t.Errorf("%s: circuit state = %v with %d calls; want %v with %d calls", step.name, got, client.calls, step.want, step.wantCalls)
+		}
+	}
+}
+
+func TestCollectorCloseWaitsForCollect(t *testing.T) {
+	client := &fakeClient{started: make(chan struct{})}
+	c := NewCollector(client, nil)
+
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+	}()
+	<-client.started
+
+	c.Close()
+	// Collect holds the lock until the fetch returns, the metrics are
+	// sent after.
+	if !client.canceled.Load() {
+		t.Fatal("Close returned before the in-flight collection")
+	}
+	<-collected
+}
+
+func TestCollectorOverlappingCollect(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	// Buffered so that a second (unexpected) fetch does not deadlock.
+	client.blocked = make(chan struct{}, 2)
+	client.unblock = make(chan struct{})
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id"}})
+
+	var wg sync.WaitGroup
+	results := make([]string, 2)
+	collect := func(i int) {
+		defer wg.Done()
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, mf := range mfs {
+			if mf.GetName() == "electrolux_appliance_pm25" {
+				results[i] = mf.String()
+			}
+		}
+	}
+
+	wg.Add(2)
+	go collect(0)
+	<-client.blocked // First collection is fetching.
+	go collect(1)
+	for testutil.ToFloat64(c.inFlight) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(client.unblock)
+	wg.Wait()
+
+	if client.calls != 1 {
+		t.Errorf("Appliances called %d times, want 1", client.calls)
+	}
+	if results[0] == "" || results[0] != results[1] {
+		t.Errorf("Overlapping collections differ:\n%s\n%s", results[0], results[1])
+	}
+
+	// Subsequent collections fetch again.
+	client.blocked = nil
+	gatherAppliance(t, c)
+	if client.calls != 2 {
+		t.Errorf("Appliances called %d times, want 2", client.calls)
+	}
+}
+
+func TestCollectorDisabledMetrics(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		DisabledMetrics: []string{"fanspeed_raw", "filter_type_id", "voc_density"},
+	})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	for _, name := range []string{"fanspeed_raw", "filter_type_id", "voc_density"} {
+		if strings.Contains(got, namespace+"_appliance_"+name+"{") {
+			t.Errorf("disabled metric %s was collected", name)
+		}
+	}
+	for _, name := range []string{"fanspeed", "tvoc_ppb"} {
+		if !strings.Contains(got, namespace+"_appliance_"+name+"{") {
+			t.Errorf("metric %s was not collected", name)
+		}
+	}
+}
+
+func TestCollectorSetOptions(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		DisabledMetrics: []string{"fanspeed_raw"},
+	})
+	defer c.Close()
+	// Registered before the options change, like the exporter.
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	gather := func() string {
+		t.Helper()
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for _, mf := range mfs {
+			if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.String()
+	}
+
+	got := gather()
+	if strings.Contains(got, namespace+"_appliance_fanspeed_raw{") {
+		t.Error("disabled metric fanspeed_raw was collected")
+	}
+
+	c.SetOptions(&Options{DisabledMetrics: []string{"tvoc_ppb"}, MolecularWeight: 78.11})
+	got = gather()
+	if !strings.Contains(got, namespace+"_appliance_fanspeed_raw{") {
+		t.Error("re-enabled metric fanspeed_raw was not collected")
+	}
+	if strings.Contains(got, namespace+"_appliance_tvoc_ppb{") {
+		t.Error("disabled metric tvoc_ppb was collected")
+	}
+	if !strings.Contains(got, "molecular weight of 78.11 g/mol") {
+		t.Errorf("voc_density help does not include the new molecular weight:\n%s", got)
+	}
+
+	c.SetOptions(&Options{DeviceTypes: []string{"WASHING_MACHINE"}})
+	if got := gather(); strings.Contains(got, namespace+"_appliance_connected{") {
+		t.Error("appliance excluded by DeviceTypes was collected")
+	}
+}
+
+func TestCollectorPM25Histogram(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		PM25Histogram: true,
+	})
+	defer c.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	for i := 0; i < 2; i++ {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, mf := range mfs {
+			if mf.GetName() != namespace+"_appliance_pm25_histogram" {
+				continue
+			}
+			found = true
+			// The reading is unchanged, it should only be observed once.
+			h := mf.GetMetric()[0].GetHistogram()
+			if h.GetSampleCount() != 1 || h.GetSampleSum() != 3 {
+				t.Errorf("gather %d: got count %d, sum %v; want 1, 3", i, h.GetSampleCount(), h.GetSampleSum())
+			}
+		}
+		if !found {
+			t.Fatalf("gather %d: pm25_histogram not found", i)
+		}
+	}
+}
+
+func TestCollectorApplianceInfoError(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	id := client.appliances[0].ApplianceID.String()
+	client.infoErr = map[string]bool{id: true}
+	c := NewCollector(client, nil)
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	for _, want := range []string{
+		namespace + `_appliance_info_error{appliance_id="` + id + `"} 1`,
+		namespace + `_appliance_up{appliance_id="` + id + `"} 1`,
+		// Sensor readings are collected without appliance info.
+		namespace + `_appliance_pm25{appliance_id="` + id + `",`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(got, namespace+"_appliance_workmode{") {
+		t.Errorf("workmode was collected without appliance info")
+	}
+}
+
+func TestCollectorForgetsRemovedAppliance(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	id := client.appliances[0].ApplianceID.String()
+	c := NewCollector(client, nil)
+	defer c.Close()
+
+	up := namespace + `_appliance_up{appliance_id="` + id + `"}`
+	if got := string(gatherAppliance(t, c)); !strings.Contains(got, up+" 1") {
+		t.Fatalf("want %s 1 in:\n%s", up, got)
+	}
+
+	// Removed from the account.
+	client.appliances = nil
+	for i := 1; i < forgetApplianceAfter; i++ {
+		if got := string(gatherAppliance(t, c)); !strings.Contains(got, up+" 0") {
+			t.Fatalf("gather %d: want %s 0 in:\n%s", i, up, got)
+		}
+	}
+	if got := string(gatherAppliance(t, c)); strings.Contains(got, up) {
+		t.Errorf("%s still reported after %d missed fetches", up, forgetApplianceAfter)
+	}
+	if len(c.seenAppliances) != 0 {
+		t.Errorf("seenAppliances = %v, want empty", c.seenAppliances)
+	}
+}
+
+func TestCollectorEmitZeroForMissing(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	c := NewCollector(client, &Options{EmitZeroForMissing: true})
+	defer c.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Previously reported properties are emitted as zero, others are
+	// still omitted.
+	client.appliances[0].Properties.Reported.PM25 = nil
+	got := string(gatherAppliance(t, c))
+	var found bool
+	for _, line := range strings.Split(got, "\n") {
+		if strings.HasPrefix(line, namespace+"_appliance_pm25{") {
+			found = true
+			if !strings.HasSuffix(line, " 0") {
+				t.Errorf("missing pm25 was not emitted as zero: %s", line)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("missing pm25 was not emitted")
+	}
+	if strings.Contains(got, namespace+"_appliance_pm25_approximate{") {
+		t.Errorf("pm25_approximate was emitted without being reported")
+	}
+}
+
+func TestCollectorReadingTimestamps(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+		ReadingTimestamps: true,
+	})
+	defer c.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{
+		"pm25": time.Date(2023, 8, 17, 20, 0, 0, 0, time.UTC).UnixMilli(),
+		// Not readings.
+		"connected":                0,
+		"scrape_timestamp_seconds": 0,
+		"workmode_changes_total":   0,
+	}
+	for _, mf := range mfs {
+		name := strings.TrimPrefix(mf.GetName(), namespace+"_appliance_")
+		wantTS, ok := want[name]
+		if !ok {
+			continue
+		}
+		delete(want, name)
+		if got := mf.GetMetric()[0].GetTimestampMs(); got != wantTS {
+			t.Errorf("%s timestamp = %d; want %d", name, got, wantTS)
+		}
+	}
+	for name := range want {
+		t.Errorf("%s not found", name)
+	}
+}
+
+func TestCollectorRequestDuration(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "pure_a9.json"), nil)
+	defer c.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != namespace+"_ocp_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			got[m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	if got["appliances"] != 1 || got["appliances_info"] != 1 {
+		t.Errorf("request counts = %v; want 1 each for appliances and appliances_info", got)
+	}
+}
+
+func TestCollectorAppliancesTotal(t *testing.T) {
+	for _, name := range []string{"pure_a9", "generic_sensors"} {
+		c := NewCollector(loadFakeClient(t, name+".json"), nil)
+		defer c.Close()
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, mf := range mfs {
+			if mf.GetName() != namespace+"_appliances_total" {
+				continue
+			}
+			found = true
+			// Skipped appliances (without -generic-sensors) are counted too.
+			if got := mf.GetMetric()[0].GetGauge().GetValue(); got != 1 {
+				t.Errorf("%s: appliances_total = %v; want 1", name, got)
+			}
+		}
+		if !found {
+			t.Errorf("%s: appliances_total not found", name)
+		}
+	}
+}
+
+func TestCollectorSkippedTotal(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "generic_sensors.json"), nil)
+	defer c.Close()
+
+	for i := 1; i <= 2; i++ {
+		gatherAppliance(t, c)
+		if got := testutil.ToFloat64(c.skippedTotal.WithLabelValues("device_type")); got != float64(i) {
+			t.Errorf("gather %d: appliances_skipped_total{reason=\"device_type\"} = %v; want %d", i, got, i)
+		}
+	}
+}
+
+func TestCollectorRecoversPanic(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	bad := client.appliances[0]
+	bad.ApplianceID = ocpapi.ApplianceID(bad.ApplianceID.PNC() + "222222225087076")
+	bad.ApplianceData.ApplianceName = "\xff" // Invalid UTF-8 label value, panics in MustNewConstMetric.
+	client.appliances = append(client.appliances, bad)
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id", "name"}})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	want := `electrolux_appliance_connected{appliance_id="950011538111111115087076",name="Living room"} 1`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+	if want := `electrolux_appliance_up{appliance_id="950011538222222225087076"} 0`; !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+	if got := testutil.ToFloat64(c.collectPanics); got != 1 {
+		t.Errorf("collect_panics_total = %v; want 1", got)
+	}
+}
+
+func TestCollectorDeviceTypes(t *testing.T) {
+	for _, tt := range []struct {
+		deviceTypes []string
+		collected   bool
+	}{
+		{nil, true},
+		{[]string{"AIR_PURIFIER"}, true},
+		{[]string{"WASHING_MACHINE"}, false},
+	} {
+		c := NewCollector(loadFakeClient(t, "pure_a9.json"), &Options{
+			Labels:      []string{"appliance_id"},
+			DeviceTypes: tt.deviceTypes,
+		})
+		got := string(gatherAppliance(t, c))
+		c.Close()
+
+		collected := strings.Contains(got, "electrolux_appliance_connected{")
+		if collected != tt.collected {
+			t.Errorf("DeviceTypes %v: collected = %v; want %v", tt.deviceTypes, collected, tt.collected)
+		}
+		if skipped := testutil.ToFloat64(c.skippedTotal.WithLabelValues("excluded")); skipped != metricutil.BoolToFloat64(!tt.collected) {
+			t.Errorf("DeviceTypes %v: appliances_skipped_total{reason=\"excluded\"} = %v", tt.deviceTypes, skipped)
+		}
+		if skipped := testutil.ToFloat64(c.skippedTotal.WithLabelValues("device_type")); skipped != 0 {
+			t.Errorf("DeviceTypes %v: appliances_skipped_total{reason=\"device_type\"} = %v; want 0", tt.deviceTypes, skipped)
+		}
+	}
+}
+
+func TestCollectorSafetyLockReported(t *testing.T) {
+	client := loadFakeClient(t, "aeg_ax7.json")
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id"}})
+	defer c.Close()
+
+	for _, lock := range []bool{true, false} {
+		client.appliances[0].Properties.Reported.SafetyLock = lock
+		got := string(gatherAppliance(t, c))
+		want := fmt.Sprintf(`electrolux_appliance_safety_lock{appliance_id="950011716222222225087076"} %v`, metricutil.BoolToFloat64(lock))
+		if !strings.Contains(got, want) {
+			t.Errorf("want %s in:\n%s", want, got)
+		}
+	}
+}
+
+func TestCollectorHumidityAsPercent(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "well_a7.json"), &Options{
+		Labels:            []string{"appliance_id"},
+		HumidityAsPercent: true,
+	})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	want := `electrolux_appliance_humidity{appliance_id="950011717333333335087076"} 45`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+}
+
+func TestCollectorPMHumidityCorrection(t *testing.T) {
+	c := NewCollector(loadFakeClient(t, "well_a7.json"), &Options{
+		Labels:               []string{"appliance_id"},
+		PMHumidityCorrection: 0.4,
+	})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	// PM2.5 3 μg/m^3 at 45% relative humidity.
+	want := `electrolux_appliance_pm25_corrected{appliance_id="950011717333333335087076"} 2.50`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+}
+
+func TestCollectorVOCDensityMissingTemp(t *testing.T) {
+	const id = "950011538111111115087076"
+	tests := []struct {
+		mode string
+		want string // VOC density without temperature, after 22°C was reported.
+	}{
+		{mode: "", want: tvocDensityString(120, 25)},
+		{mode: "default25", want: tvocDensityString(120, 25)},
+		{mode: "last", want: tvocDensityString(120, 22)},
+		{mode: "skip", want: ""},
+	}
+	for _, tt := range tests {
+		client := loadFakeClient(t, "pure_a9.json")
+		c := NewCollector(client, &Options{
+			Labels:                []string{"appliance_id"},
+			VOCDensityMissingTemp: tt.mode,
+		})
+
+		gatherAppliance(t, c)
+		client.appliances[0].Properties.Reported.Temp = nil
+		got := string(gatherAppliance(t, c))
+		c.Close()
+
+		metric := `electrolux_appliance_voc_density{appliance_id="` + id + `"} `
+		if tt.want == "" {
+			if strings.Contains(got, metric) {
+				t.Errorf("mode %q: want no VOC density in:\n%s", tt.mode, got)
+			}
+			continue
+		}
+		if !strings.Contains(got, metric+tt.want+"\n") {
+			t.Errorf("mode %q: want %s in:\n%s", tt.mode, metric+tt.want, got)
+		}
+	}
+}
+
+func tvocDensityString(ppb, temp int) string {
+	return strconv.FormatFloat(metricutil.Round(tvocPPBToVocDensity(ppb, temp, 30.026), 2), 'g', -1, 64)
+}
+
+func TestCollectorRawMode(t *testing.T) {
+	client := loadFakeClient(t, "well_a7.json")
+	got := string(gatherAppliance(t, NewCollector(client, &Options{Labels: []string{"appliance_id"}})))
+	if strings.Contains(got, "electrolux_appliance_raw") {
+		t.Errorf("raw metrics emitted without RawMode:\n%s", got)
+	}
+
+	c := NewCollector(client, &Options{
+		Labels:  []string{"appliance_id"},
+		RawMode: true,
+	})
+	defer c.Close()
+
+	got = string(gatherAppliance(t, c))
+	for _, want := range []string{
+		`electrolux_appliance_raw{appliance_id="950011717333333335087076",field="Fanspeed"} 3`,
+		`electrolux_appliance_raw{appliance_id="950011717333333335087076",field="PM2_5"} 3`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %s in:\n%s", want, got)
+		}
+	}
+}
+
+func TestCollectorSchemaDrift(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	// E.g. all properties renamed by the API.
+	client.appliances[0].Properties.Reported = ocpapi.Reported{}
+
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id"}})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	want := `electrolux_appliance_schema_drift{appliance_id="950011538111111115087076"} 1`
+	if !strings.Contains(got, want) {
+		t.Errorf("want %s in:\n%s", want, got)
+	}
+}
+
+func TestWiFiQuality(t *testing.T) {
+	tests := []struct {
+		rssi int
+		want float64
+	}{
+		{rssi: -110, want: 0},
+		{rssi: -100, want: 0},
+		{rssi: -75, want: 50},
+		{rssi: -50, want: 100},
+		{rssi: -30, want: 100},
+	}
+	for _, tt := range tests {
+		if got := wifiQuality(tt.rssi); got != tt.want {
+			t.Errorf("wifiQuality(%d) = %v; want %v", tt.rssi, got, tt.want)
+		}
+	}
+}
+
+func TestFaultCodes(t *testing.T) {
+	yes, no := true, false
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		reported ocpapi.Reported
+		want     []string
+		wantOK   bool
+	}{
+		{name: "none reported"},
+		{name: "no faults", reported: ocpapi.Reported{ErrFanMtr: &no, ErrImpellerStuck: str("false")}, wantOK: true},
+		{name: "bool fault", reported: ocpapi.Reported{ErrFanMtr: &yes, ErrRFID: &no}, want: []string{"ErrFanMtr"}, wantOK: true},
+		{name: "string fault", reported: ocpapi.Reported{ErrImpellerStuck: str("True"), ErrPmNotResp: str("0")}, want: []string{"ErrImpellerStuck"}, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := faultCodes(tt.reported)
+			if !slices.Equal(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("faultCodes() = %v, %t; want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFanspeed(t *testing.T) {
+	tests := []struct {
+		model    string
+		speed    int
+		wantPerc float64
+		wantMax  float64
+		wantOK   bool
+	}{
+		{model: "PUREA9", speed: 9, wantPerc: 1, wantMax: 9, wantOK: true},
+		{model: "AX9", speed: 3, wantPerc: 3.0 / 9, wantMax: 9, wantOK: true},
+		{model: "WELLA5", speed: 1, wantPerc: 0.2, wantMax: 5, wantOK: true},
+		{model: "AX5", speed: 5, wantPerc: 1, wantMax: 5, wantOK: true},
+		{model: "WELLA7", speed: 2, wantPerc: 0.4, wantMax: 5, wantOK: true},
+		{model: "AX7", speed: 4, wantPerc: 0.8, wantMax: 5, wantOK: true},
+		{model: "FLOWA3", speed: 3, wantPerc: 1, wantMax: 3, wantOK: true},
+		{model: "AX3", speed: 1, wantPerc: 1.0 / 3, wantMax: 3, wantOK: true},
+		{model: "Muju", speed: 2, wantPerc: 2.0 / 3, wantMax: 3, wantOK: true},
+		{model: "PURE500", speed: 0, wantPerc: 0, wantMax: 3, wantOK: true},
+		{model: "UNKNOWN", speed: 5, wantOK: false},
+		{model: "", speed: 1, wantOK: false},
+	}
+	for _, tt := range tests {
+		perc, max, ok := fanspeed(tt.model, tt.speed)
+		if perc != tt.wantPerc || max != tt.wantMax || ok != tt.wantOK {
+			t.Errorf("fanspeed(%q, %d) = %v, %v, %v; want %v, %v, %v", tt.model, tt.speed, perc, max, ok, tt.wantPerc, tt.wantMax, tt.wantOK)
+		}
+	}
+}
+
+func TestCollectorFanspeedMax(t *testing.T) {
+	c := NewCollector(nil, &Options{
+		FanspeedMax: map[string]float64{
+			"950011538111111115087076": 10,
+			"PUREA9":                   8,
+			"NEWMODEL":                 4,
+		},
+	})
+	tests := []struct {
+		applianceID string
+		model       string
+		speed       int
+		wantPerc    float64
+		wantMax     float64
+		wantOK      bool
+	}{
+		{applianceID: "950011538111111115087076", model: "PUREA9", speed: 5, wantPerc: 0.5, wantMax: 10, wantOK: true},
+		{applianceID: "other", model: "PUREA9", speed: 4, wantPerc: 0.5, wantMax: 8, wantOK: true},
+		{applianceID: "other", model: "NEWMODEL", speed: 1, wantPerc: 0.25, wantMax: 4, wantOK: true},
+		{applianceID: "other", model: "WELLA5", speed: 1, wantPerc: 0.2, wantMax: 5, wantOK: true},
+		{applianceID: "other", model: "UNKNOWN", speed: 1, wantOK: false},
+	}
+	for _, tt := range tests {
+		perc, max, ok := c.fanspeed(tt.applianceID, tt.model, tt.speed)
+		if perc != tt.wantPerc || max != tt.wantMax || ok != tt.wantOK {
+			t.Errorf("fanspeed(%q, %q, %d) = %v, %v, %v; want %v, %v, %v", tt.applianceID, tt.model, tt.speed, perc, max, ok, tt.wantPerc, tt.wantMax, tt.wantOK)
+		}
+	}
+}
+
+func TestCollectorFanspeedPrecision(t *testing.T) {
+	zero, none := 0, -1
+	for _, tt := range []struct {
+		precision *int
+		want      string
+	}{
+		{nil, "0.33"},
+		{&zero, "0"},
+		{&none, "0.3333333333333333"},
+	} {
+		client := loadFakeClient(t, "pure_a9.json")
+		client.appliances[0].Properties.Reported.Fanspeed = 3
+		c := NewCollector(client, &Options{FanspeedPrecision: tt.precision, Labels: []string{"appliance_id"}})
+		got := string(gatherAppliance(t, c))
+		c.Close()
+		want := `electrolux_appliance_fanspeed{appliance_id="950011538111111115087076"} ` + tt.want + "\n"
+		if !strings.Contains(got, want) {
+			t.Errorf("precision %v: want %s in:\n%s", tt.precision, want, got)
+		}
+	}
+}
+
+func TestFilterReplacementEstimate(t *testing.T) {
+	start := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	samples := func(lives ...float64) (s []filterLifeSample) {
+		for i, life := range lives {
+			s = addFilterLifeSample(s, filterLifeSample{at: start.Add(time.Duration(i) * day), life: life})
+		}
+		return s
+	}
+	tests := []struct {
+		name    string
+		samples []filterLifeSample
+		want    time.Time
+		wantOK  bool
+	}{
+		{name: "single sample", samples: samples(50)},
+		{name: "unchanged", samples: samples(50, 50, 50)},
+		{name: "decreasing", samples: samples(50, 49, 48), want: start.Add(50 * day), wantOK: true},
+		{name: "replaced", samples: samples(2, 1, 100)},
+		{name: "replaced and decreasing", samples: samples(2, 100, 99), want: start.Add(101 * day), wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := filterReplacementEstimate(tt.samples)
+			if !got.Equal(tt.want) || ok != tt.wantOK {
+				t.Errorf("filterReplacementEstimate() = %v, %t; want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCollectorFilterReplacementEstimate(t *testing.T) {
+	client := loadFakeClient(t, "aeg_ax7.json")
+	c := NewCollector(client, nil)
+	defer c.Close()
+
+	metric := "electrolux_appliance_filter_replacement_estimate_timestamp_seconds"
+	if got := string(gatherAppliance(t, c)); strings.Contains(got, metric+"{") {
+		t.Fatalf("estimate emitted after a single sample:\n%s", got)
+	}
+
+	reported := &client.appliances[0].Properties.Reported
+	life := *reported.FilterLife - 1
+	reported.FilterLife = &life
+	reported.Metadata.FilterLife.LastUpdated = reported.Metadata.FilterLife.LastUpdated.Add(24 * time.Hour)
+
+	// 45% on 2023-08-17, 44% a day later.
+	want := time.Date(2023, 8, 17, 20, 0, 0, 0, time.UTC).Add(45 * 24 * time.Hour)
+	got := string(gatherAppliance(t, c))
+	if !strings.Contains(got, fmt.Sprintf(`filter="primary",model="AX7",model_name="AX7",name="Bedroom",pnc="950011716",product_area="WELLBEING",variant="AX71-304GY"} %g`, float64(want.Unix()))) {
+		t.Errorf("want estimate %v in:\n%s", want, got)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "2.1.4", b: "2.1.4", want: 0},
+		{a: "2.1.4", b: "2.1.10", want: -1},
+		{a: "3.0", b: "2.9.9", want: 1},
+		{a: "2.1", b: "2.1.1", want: -1},
+		{a: "2.1.b", b: "2.1.a", want: 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d; want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCollectorWorkmodeChanges(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id"}})
+	defer c.Close()
+
+	for i, tt := range []struct {
+		workmode string
+		want     int
+	}{
+		{"Auto", 0},
+		{"Manual", 1},
+		{"Manual", 1},
+		{"Auto", 2},
+	} {
+		client.appliances[0].Properties.Reported.Workmode = tt.workmode
+		got := string(gatherAppliance(t, c))
+		want := fmt.Sprintf(`electrolux_appliance_workmode_changes_total{appliance_id="950011538111111115087076"} %d`, tt.want)
+		if !strings.Contains(got, want) {
+			t.Errorf("gather %d: want %s in:\n%s", i, want, got)
+		}
+	}
+}
+
+func TestCollectorFirmwareOutdated(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	// A second Pure A9 on older firmware.
+	older := client.appliances[0]
+	older.ApplianceID = "950011538111111115099999"
+	fw := "3.0.0"
+	older.Properties.Reported.FrmVerNIU = &fw
+	client.appliances = append(client.appliances, older)
+
+	c := NewCollector(client, &Options{Labels: []string{"appliance_id"}})
+	defer c.Close()
+
+	got := string(gatherAppliance(t, c))
+	for _, want := range []string{
+		`electrolux_appliance_firmware_outdated{appliance_id="950011538111111115087076"} 0`,
+		`electrolux_appliance_firmware_outdated{appliance_id="950011538111111115099999"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %s in:\n%s", want, got)
+		}
+	}
+}
+
+func TestTVOCPPBToVocDensity(t *testing.T) {
+	const (
+		formaldehyde = 30.026 // CH2O.
+		benzene      = 78.11  // C6H6.
+	)
+	tests := []struct {
+		ppb             int
+		temperature     int
+		molecularWeight float64
+		want            float64
+	}{
+		{ppb: 1000, temperature: 0, molecularWeight: formaldehyde, want: 1339.6110},
+		// At 25°C one mole of gas occupies ~24.45 L, i.e. ppb * MW / 24.45.
+		{ppb: 1000, temperature: 25, molecularWeight: formaldehyde, want: 1227.2841},
+		{ppb: 1000, temperature: -10, molecularWeight: formaldehyde, want: 1390.5177},
+		{ppb: 0, temperature: 25, molecularWeight: formaldehyde, want: 0},
+		{ppb: 250, temperature: 0, molecularWeight: benzene, want: 871.2201},
+		{ppb: 500, temperature: 25, molecularWeight: benzene, want: 1596.3358},
+	}
+	for _, tt := range tests {
+		got := tvocPPBToVocDensity(tt.ppb, tt.temperature, tt.molecularWeight)
+		if math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("tvocPPBToVocDensity(%d, %d, %v) = %v; want %v", tt.ppb, tt.temperature, tt.molecularWeight, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMolecularWeight(t *testing.T) {
+	for _, mw := range []float64{30.026, 78.11, 10, 1000} {
+		if err := ValidateMolecularWeight(mw); err != nil {
+			t.Errorf("ValidateMolecularWeight(%v) = %v; want nil", mw, err)
+		}
+	}
+	for _, mw := range []float64{0, -30, 9.9, 30026, math.NaN(), math.Inf(1)} {
+		if err := ValidateMolecularWeight(mw); err == nil {
+			t.Errorf("ValidateMolecularWeight(%v) = nil; want error", mw)
+		}
+	}
+}
+
+func TestPMHumidityCorrected(t *testing.T) {
+	tests := []struct {
+		name  string
+		pm    float64
+		rh    float64
+		kappa float64
+		want  float64
+	}{
+		{name: "dry", pm: 10, rh: 0, kappa: 0.4, want: 10},
+		{name: "no kappa", pm: 10, rh: 80, kappa: 0, want: 10},
+		{name: "half", pm: 10, rh: 50, kappa: 0.4, want: 8.0488},
+		{name: "humid", pm: 10, rh: 90, kappa: 0.4, want: 3.1429},
+		{name: "saturated capped", pm: 10, rh: 100, kappa: 0.4, want: 0.4},
+	}
+	for _, tt := range tests {
+		if got := pmHumidityCorrected(tt.pm, tt.rh, tt.kappa); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("%s: pmHumidityCorrected(%v, %v, %v) = %v; want %v", tt.name, tt.pm, tt.rh, tt.kappa, got, tt.want)
+		}
+	}
+}
+
+func TestAQI(t *testing.T) {
+	tests := []struct {
+		name        string
+		breakpoints []aqiBreakpoint
+		c           float64
+		want        float64
+	}{
+		{name: "pm25 zero", breakpoints: pm25AQIBreakpoints, c: 0, want: 0},
+		{name: "pm25 good upper", breakpoints: pm25AQIBreakpoints, c: 9, want: 50},
+		{name: "pm25 between ranges", breakpoints: pm25AQIBreakpoints, c: 9.05, want: 51},
+		{name: "pm25 moderate", breakpoints: pm25AQIBreakpoints, c: 20, want: 71},
+		{name: "pm25 unhealthy", breakpoints: pm25AQIBreakpoints, c: 100, want: 182},
+		{name: "pm25 hazardous upper", breakpoints: pm25AQIBreakpoints, c: 325.4, want: 500},
+		{name: "pm25 beyond", breakpoints: pm25AQIBreakpoints, c: 350, want: 549},
+		{name: "pm10 good", breakpoints: pm10AQIBreakpoints, c: 27, want: 25},
+		{name: "pm10 moderate", breakpoints: pm10AQIBreakpoints, c: 100, want: 73},
+		{name: "pm10 between ranges", breakpoints: pm10AQIBreakpoints, c: 54.5, want: 51},
+		{name: "pm10 hazardous upper", breakpoints: pm10AQIBreakpoints, c: 604, want: 500},
+	}
+	for _, tt := range tests {
+		if got := aqi(tt.breakpoints, tt.c); got != tt.want {
+			t.Errorf("%s: aqi(%v) = %v; want %v", tt.name, tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// ErrorKind describes the cause of a FetchError.
+type ErrorKind int
+
+// Error kinds.
+const (
+	ErrorKindUnknown ErrorKind = iota
+	ErrorKindAuth              // Not logged in, token refresh failed or the request was unauthorized.
+	ErrorKindNetwork           // The request could not be sent or timed out.
+	ErrorKindDecode            // The response could not be decoded.
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindAuth:
+		return "auth"
+	case ErrorKindNetwork:
+		return "network"
+	case ErrorKindDecode:
+		return "decode"
+	default:
+		return "unknown"
+	}
+}
+
+// FetchError is returned when fetching appliance data from the OCP API
+// fails.
+type FetchError struct {
+	Op   string // The API operation, e.g. "appliances".
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *FetchError) Error() string {
+	return e.Op + ": " + e.Kind.String() + " error: " + e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+func newFetchError(op string, err error) *FetchError {
+	return &FetchError{Op: op, Kind: errorKind(err), Err: err}
+}
+
+// errorKind classifies err. The OCP API client doesn't export error types
+// for authentication failures, so those are detected by their message.
+func errorKind(err error) ErrorKind {
+	var (
+		netErr       net.Error
+		syntaxErr    *json.SyntaxError
+		unmarshalErr *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &syntaxErr), errors.As(err, &unmarshalErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorKindDecode
+	case errors.As(err, &netErr):
+		return ErrorKindNetwork
+	}
+
+	msg := err.Error()
+	for _, s := range []string{"please login", "refresh failed", "client token:", ": 401,", ": 403,"} {
+		if strings.Contains(msg, s) {
+			return ErrorKindAuth
+		}
+	}
+	return ErrorKindUnknown
+}
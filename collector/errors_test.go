@@ -0,0 +1,67 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorKind(t *testing.T) {
+	decodeErr := json.Unmarshal([]byte("{"), &struct{}{})
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{name: "not logged in", err: errors.New("please login before using this endpoint"), want: ErrorKindAuth},
+		{name: "refresh failed", err: errors.New("auth token expired: refresh failed: do: EOF"), want: ErrorKindAuth},
+		{name: "unauthorized", err: errors.New(`unexpected status code for "/api/v1/appliances": 401, body: `), want: ErrorKindAuth},
+		{name: "network", err: fmt.Errorf("http client do: %w", &url.Error{Op: "Get", URL: "https://example.com", Err: context.DeadlineExceeded}), want: ErrorKindNetwork},
+		{name: "decode", err: fmt.Errorf("decode response: %w", decodeErr), want: ErrorKindDecode},
+		{name: "server error", err: errors.New(`unexpected status code for "/api/v1/appliances": 500, body: `), want: ErrorKindUnknown},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("%s: errorKind() = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectorFetchError(t *testing.T) {
+	wantErr := errors.New("please login before using this endpoint")
+	c := NewCollector(&fakeClient{err: wantErr}, nil)
+	defer c.Close()
+
+	_, err := c.fetch(context.Background())
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("fetch() error = %v; want *FetchError", err)
+	}
+	if fetchErr.Kind != ErrorKindAuth || !errors.Is(err, wantErr) {
+		t.Errorf("fetch() error = %v (kind %v); want auth error wrapping %v", err, fetchErr.Kind, wantErr)
+	}
+}
+
+func TestCollectorLastError(t *testing.T) {
+	client := loadFakeClient(t, "pure_a9.json")
+	c := NewCollector(client, nil)
+	defer c.Close()
+
+	client.err = errors.New("please login before using this endpoint")
+	testutil.CollectAndCount(c)
+	var fetchErr *FetchError
+	if err := c.LastError(); !errors.As(err, &fetchErr) || fetchErr.Kind != ErrorKindAuth {
+		t.Errorf("LastError() = %v; want auth *FetchError", err)
+	}
+
+	client.err = nil
+	testutil.CollectAndCount(c)
+	if err := c.LastError(); err != nil {
+		t.Errorf("LastError() = %v after successful fetch; want nil", err)
+	}
+}
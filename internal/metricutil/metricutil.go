@@ -0,0 +1,55 @@
+// Package metricutil contains helpers for converting appliance properties
+// to metric values.
+package metricutil
+
+import "math"
+
+// Value is a property value that can be converted to a metric value.
+type Value interface {
+	int | float64 | bool
+}
+
+// Float64 converts v to float64, true is 1 and false is 0.
+func Float64[T Value](v T) float64 {
+	switch v := any(v).(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	case bool:
+		return BoolToFloat64(v)
+	default:
+		panic("unreachable")
+	}
+}
+
+// MaybeFloat64 converts the value of v to float64, ok is false if v is nil.
+func MaybeFloat64[T Value](v *T) (f float64, ok bool) {
+	if v == nil {
+		return 0, false
+	}
+	return Float64(*v), true
+}
+
+// Maybe returns the value of s, or the zero value if s is nil.
+func Maybe[T any](s *T) T {
+	var empty T
+	if s == nil {
+		return empty
+	}
+	return *s
+}
+
+// Round rounds f to the given number of decimals.
+func Round(f float64, decimals int) float64 {
+	shift := math.Pow(10, float64(decimals))
+	return math.Round(f*shift) / shift
+}
+
+// BoolToFloat64 returns 1 for true and 0 for false.
+func BoolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
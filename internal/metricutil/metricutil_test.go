@@ -0,0 +1,73 @@
+package metricutil
+
+import "testing"
+
+func TestFloat64(t *testing.T) {
+	if got := Float64(3); got != 3 {
+		t.Errorf("Float64(3) = %v; want 3", got)
+	}
+	if got := Float64(1.5); got != 1.5 {
+		t.Errorf("Float64(1.5) = %v; want 1.5", got)
+	}
+	if got := Float64(true); got != 1 {
+		t.Errorf("Float64(true) = %v; want 1", got)
+	}
+	if got := Float64(false); got != 0 {
+		t.Errorf("Float64(false) = %v; want 0", got)
+	}
+}
+
+func TestMaybeFloat64(t *testing.T) {
+	i := 42
+	if got, ok := MaybeFloat64(&i); got != 42 || !ok {
+		t.Errorf("MaybeFloat64(&42) = %v, %v; want 42, true", got, ok)
+	}
+	b := true
+	if got, ok := MaybeFloat64(&b); got != 1 || !ok {
+		t.Errorf("MaybeFloat64(&true) = %v, %v; want 1, true", got, ok)
+	}
+	if got, ok := MaybeFloat64[int](nil); got != 0 || ok {
+		t.Errorf("MaybeFloat64(nil) = %v, %v; want 0, false", got, ok)
+	}
+}
+
+func TestMaybe(t *testing.T) {
+	s := "3.0.1"
+	if got := Maybe(&s); got != s {
+		t.Errorf("Maybe(&%q) = %q; want %q", s, got, s)
+	}
+	if got := Maybe[string](nil); got != "" {
+		t.Errorf("Maybe(nil) = %q; want empty", got)
+	}
+}
+
+func TestBoolToFloat64(t *testing.T) {
+	if got := BoolToFloat64(true); got != 1 {
+		t.Errorf("BoolToFloat64(true) = %v; want 1", got)
+	}
+	if got := BoolToFloat64(false); got != 0 {
+		t.Errorf("BoolToFloat64(false) = %v; want 0", got)
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		f        float64
+		decimals int
+		want     float64
+	}{
+		{f: 1.0 / 3, decimals: 0, want: 0},
+		{f: 2.0 / 3, decimals: 0, want: 1},
+		{f: 1.0 / 3, decimals: 2, want: 0.33},
+		{f: 2.0 / 3, decimals: 2, want: 0.67},
+		{f: 0.125, decimals: 2, want: 0.13},
+		{f: 1.23456, decimals: 4, want: 1.2346},
+		{f: -1.005, decimals: 1, want: -1},
+		{f: 1234.5, decimals: -2, want: 1200},
+	}
+	for _, tt := range tests {
+		if got := Round(tt.f, tt.decimals); got != tt.want {
+			t.Errorf("Round(%v, %d) = %v; want %v", tt.f, tt.decimals, got, tt.want)
+		}
+	}
+}